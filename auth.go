@@ -0,0 +1,147 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: auth.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:40:12
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:44:21
+ */
+
+package socks5lb
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is a client account allowed to use the frontend listeners
+type User struct {
+	Username string `yaml:"username"`
+	// Password is either plain text or a bcrypt hash like "$2y$10$..."
+	Password string `yaml:"password"`
+}
+
+// UserStore holds the accounts checked during the frontend authentication
+type UserStore struct {
+	users map[string]string
+	lock  sync.RWMutex
+}
+
+// isBcryptHash reports whether the password looks like a bcrypt hash
+func isBcryptHash(password string) bool {
+	return strings.HasPrefix(password, "$2a$") ||
+		strings.HasPrefix(password, "$2b$") ||
+		strings.HasPrefix(password, "$2y$")
+}
+
+// readHtpasswd parses an htpasswd-style file with "username:bcrypt-hash" lines
+func readHtpasswd(path string) (users []User, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, found := strings.Cut(text, ":")
+		if !found || username == "" {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, line)
+		}
+
+		// Only bcrypt is accepted, other htpasswd hash formats are too weak
+		if !isBcryptHash(hash) {
+			return nil, fmt.Errorf("%s:%d: password of %s is not a bcrypt hash", path, line, username)
+		}
+
+		users = append(users, User{Username: username, Password: hash})
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// Load replaces all accounts with the configured users and the ones from the htpasswd file
+func (u *UserStore) Load(users []User, path string) (err error) {
+	if path != "" {
+		fileUsers, err := readHtpasswd(path)
+		if err != nil {
+			return err
+		}
+		users = append(users, fileUsers...)
+	}
+
+	accounts := make(map[string]string, len(users))
+	for _, user := range users {
+		if user.Username == "" {
+			return fmt.Errorf("user with empty username is not allowed")
+		}
+		if _, ok := accounts[user.Username]; ok {
+			return fmt.Errorf("user %s is defined more than once", user.Username)
+		}
+		accounts[user.Username] = user.Password
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.users = accounts
+	return
+}
+
+// Enabled reports whether clients have to authenticate
+func (u *UserStore) Enabled() bool {
+	if u == nil {
+		return false
+	}
+
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return len(u.users) > 0
+}
+
+// Authenticate checks the credentials against the stored accounts
+func (u *UserStore) Authenticate(username, password string) bool {
+	if u == nil {
+		return false
+	}
+
+	u.lock.RLock()
+	expected, ok := u.users[username]
+	u.lock.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	if isBcryptHash(expected) {
+		return bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// NewUserStore creates a user store from the configured users and an optional htpasswd file
+func NewUserStore(users []User, path string) (store *UserStore, err error) {
+	store = &UserStore{}
+	if err = store.Load(users, path); err != nil {
+		return nil, err
+	}
+
+	return
+}
@@ -0,0 +1,62 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: auth_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:42:30
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:44:21
+ */
+
+package socks5lb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUserStore_Authenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed-secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte("# comment\nalice:"+string(hash)+"\n"), 0600))
+
+	store, err := NewUserStore([]User{{Username: "bob", Password: "plain-secret"}}, path)
+	assert.NoError(t, err)
+	assert.True(t, store.Enabled())
+
+	assert.True(t, store.Authenticate("alice", "hashed-secret"))
+	assert.True(t, store.Authenticate("bob", "plain-secret"))
+	assert.False(t, store.Authenticate("alice", "plain-secret"))
+	assert.False(t, store.Authenticate("carol", ""))
+}
+
+func TestUserStore_Disabled(t *testing.T) {
+	store, err := NewUserStore(nil, "")
+	assert.NoError(t, err)
+	assert.False(t, store.Enabled())
+
+	var empty *UserStore
+	assert.False(t, empty.Enabled())
+	assert.False(t, empty.Authenticate("", ""))
+}
+
+func TestUserStore_InvalidHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte("alice:{SHA}weak\n"), 0600))
+
+	_, err := NewUserStore(nil, path)
+	assert.Error(t, err)
+
+	_, err = NewUserStore([]User{{Username: "bob"}, {Username: "bob"}}, "")
+	assert.Error(t, err)
+}
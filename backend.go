@@ -9,15 +9,23 @@
  * File Created: Tuesday, June 21st 2022, 6:03:26 pm
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:21:59
+ * Last Modified: 2026-10-18 10:26:59
  */
 
 package socks5lb
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -28,12 +36,44 @@ import (
 const (
 	// DefaultCheckTimeout is the default timeout for health checks
 	DefaultCheckTimeout = 10
+	// DefaultWeight is the weight of a backend without an explicit one
+	DefaultWeight = 1
+	// LatencySmoothing is the weight of a new sample in the moving average of the latency
+	LatencySmoothing = 0.3
 )
 
 type BackendCheckConfig struct {
+	Type         string `yaml:"type" json:"type"` // http with a check URL by default, socks5, tcp or udp_dns
 	CheckURL     string `yaml:"check_url" json:"check_url"`
+	CheckTarget  string `yaml:"check_target" json:"check_target"` // host:port the tcp check connects to, optional for socks5
 	InitialAlive bool   `yaml:"initial_alive" json:"initial_alive"`
 	Timeout      uint   `yaml:"timeout" json:"timeout"`
+	Interval     uint   `yaml:"interval" json:"interval"` // seconds between two checks, overrides the interval of the scheduler
+
+	// Requests and expectations of the http check
+	CheckURLs       []string          `yaml:"check_urls" json:"check_urls"`               // further URLs checked besides the check URL
+	Require         string            `yaml:"require" json:"require"`                     // all or any of the URLs have to pass, default all
+	Method          string            `yaml:"method" json:"method"`                       // default HEAD, or GET when the body has to match
+	Headers         map[string]string `yaml:"headers" json:"headers"`                     // request headers, Host included
+	ExpectStatus    []int             `yaml:"expect_status" json:"expect_status"`         // accepted status codes, default 2xx and 3xx
+	ExpectBody      string            `yaml:"expect_body" json:"expect_body"`             // substring the body must contain
+	ExpectBodyRegex string            `yaml:"expect_body_regex" json:"expect_body_regex"` // regular expression the body must match
+	TLS             CheckTLSConfig    `yaml:"tls" json:"tls"`
+
+	// Payload and expectations of the tcp check
+	Send        string `yaml:"send" json:"send"`                 // data written to the check target, optional
+	Expect      string `yaml:"expect" json:"expect"`             // prefix the response must start with
+	ExpectRegex string `yaml:"expect_regex" json:"expect_regex"` // regular expression the response must match
+
+	// DNS checks the UDP relay of the backend besides the main check, also used by the udp_dns type
+	DNS *DNSCheckConfig `yaml:"udp_dns" json:"udp_dns,omitempty"`
+
+	// Single check results only change the state of the backend after a few in a row
+	Rise          uint `yaml:"rise" json:"rise"`                     // passing checks bringing the backend back, default 2
+	Fall          uint `yaml:"fall" json:"fall"`                     // failing checks taking the backend down, default 3
+	FlapThreshold uint `yaml:"flap_threshold" json:"flap_threshold"` // state changes within the flap window damping the backend, default 4
+	FlapWindow    uint `yaml:"flap_window" json:"flap_window"`       // seconds the state changes are counted over, default 600
+	FlapPenalty   uint `yaml:"flap_penalty" json:"flap_penalty"`     // seconds a damped backend is kept down, default 300
 }
 
 type Backend struct {
@@ -41,69 +81,268 @@ type Backend struct {
 	UserName    string             `yaml:"username" json:"username"`
 	Password    string             `yaml:"password" json:"password"`
 	CheckConfig BackendCheckConfig `yaml:"check_config" json:"check_config"`
+	Weight      int                `yaml:"weight" json:"weight" binding:"min=0"`
+	Group       string             `yaml:"group" json:"group"` // routing rules send targets to backend groups by name
+
+	breaker circuitBreaker // Decides whether the backend takes connections, replaces the former alive flag
+	active  int64          // Number of client connections currently carried by the backend
+	latency int64          // Moving average of the handshake latency in nanoseconds, 0 until measured
+	passive passiveHealth
+	health  healthState // Rise and fall counters and the state history of the health checks
+	udp     healthState // State of the UDP relay by the udp_dns check
+	exit    exitState   // Public IP the backend egresses from
+	removed atomic.Bool // Set once the backend left the pool, balancers drop their state of it
+}
+
+// EffectiveWeight returns the weight used by the weighted strategies, DefaultWeight if unset
+func (b *Backend) EffectiveWeight() int {
+	if b.Weight <= 0 {
+		return DefaultWeight
+	}
+	return b.Weight
+}
+
+// MarshalJSON adds the runtime state of the backend to its configuration
+func (b *Backend) MarshalJSON() ([]byte, error) {
+	type config Backend
+	return json.Marshal(struct {
+		*config
+		Alive               bool          `json:"alive"`
+		ActiveConnections   int64         `json:"active_connections"`
+		LatencyMs           float64       `json:"latency_ms"`
+		ConsecutiveFailures uint          `json:"consecutive_failures"`
+		Breaker             BreakerStatus `json:"breaker"`
+		Health              HealthStatus  `json:"health"`
+		UDP                 *HealthStatus `json:"udp,omitempty"`
+		Exit                *ExitInfo     `json:"exit,omitempty"`
+	}{
+		config:              (*config)(b),
+		Alive:               b.Alive(),
+		ActiveConnections:   b.ActiveConns(),
+		LatencyMs:           float64(b.Latency()) / float64(time.Millisecond),
+		ConsecutiveFailures: b.ConsecutiveFailures(),
+		Breaker:             b.Breaker(),
+		Health:              b.Health(),
+		UDP:                 b.UDP(),
+		Exit:                b.Exit(),
+	})
+}
+
+// Latency returns the exponentially weighted moving average of the handshake latency,
+// zero means the backend has not been measured yet
+func (b *Backend) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.latency))
+}
+
+// observeLatency folds a new handshake latency sample into the moving average
+func (b *Backend) observeLatency(sample time.Duration) {
+	if sample <= 0 {
+		sample = 1
+	}
+
+	for {
+		old := atomic.LoadInt64(&b.latency)
+
+		// The first sample seeds the average
+		next := int64(sample)
+		if old > 0 {
+			next = old + int64(LatencySmoothing*float64(int64(sample)-old))
+		}
+
+		if atomic.CompareAndSwapInt64(&b.latency, old, next) {
+			return
+		}
+	}
+}
 
-	alive int32 // Use atomic int32 for thread-safe status updates (1=alive, 0=dead)
+// ActiveConns returns the number of client connections currently carried by the backend
+func (b *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&b.active)
 }
 
-// Alive returns the current health status of the backend
-// Uses atomic operation for thread-safe read
+// acquire marks a client connection as carried by the backend, it must be paired with release
+func (b *Backend) acquire() {
+	atomic.AddInt64(&b.active, 1)
+}
+
+// release marks a client connection of the backend as finished
+func (b *Backend) release() {
+	atomic.AddInt64(&b.active, -1)
+}
+
+// Alive returns whether the circuit breaker of the backend lets connections through,
+// a half-open backend is alive as long as it has trial connections left
 func (b *Backend) Alive() bool {
-	return atomic.LoadInt32(&b.alive) == 1
+	return b.breaker.available()
 }
 
-// SetAlive atomically sets the backend's health status
+// SetAlive closes the circuit breaker of a healthy backend unless failing connections tripped
+// it, an unhealthy one is kept open until it is set alive again
 func (b *Backend) SetAlive(alive bool) {
 	if alive {
-		atomic.StoreInt32(&b.alive, 1)
+		b.breaker.close()
 	} else {
-		atomic.StoreInt32(&b.alive, 0)
+		b.breaker.hold()
 	}
 }
 
-// Check performs health check on the backend by testing connectivity
+// Check performs health check on the backend by testing connectivity, the backend only
+// changes its state after the rise or fall count of results in a row
 // Returns error if the backend is not reachable or unhealthy
 func (b *Backend) Check() (err error) {
-	// If check URL is configured, use HTTP health check
-	if url := b.CheckConfig.CheckURL; url != "" {
-		err = b.httpHealthCheck(url)
-		if err != nil {
-			log.Errorf("HTTP health check failed for %s: %v", b.Addr, err)
-			b.SetAlive(false)
-			return
-		}
-		b.SetAlive(true)
+	_, err = b.check()
+	return
+}
+
+// check runs the health check of the backend, returns whether its state changed
+func (b *Backend) check() (changed bool, err error) {
+	switch checkType := b.CheckConfig.checkType(); checkType {
+	case "":
+		// Fall back to initial configuration if the backend is not checked
+		b.SetAlive(b.CheckConfig.InitialAlive)
 		return
+
+	case CheckTypeHTTP:
+		err = b.httpHealthCheck()
+
+	case CheckTypeSocks5:
+		err = b.socks5HealthCheck()
+
+	case CheckTypeTCP:
+		err = b.tcpHealthCheck()
+
+	case CheckTypeUDPDNS:
+		err = b.dnsHealthCheck()
+
+	default:
+		err = fmt.Errorf("unknown check type %s", checkType)
 	}
 
-	// Fall back to initial configuration if no check URL
-	b.SetAlive(b.CheckConfig.InitialAlive)
-	return
+	if err != nil {
+		log.Errorf("%s health check failed for %s: %v", b.CheckConfig.checkType(), b.Addr, err)
+	}
+
+	changed = b.recordCheck(err)
+
+	// The UDP relay is checked besides the main check unless that is the udp_dns check already
+	switch {
+	case b.CheckConfig.Type == CheckTypeUDPDNS:
+		changed = b.recordUDPCheck(err) || changed
+	case b.CheckConfig.DNS != nil:
+		udpErr := b.dnsHealthCheck()
+		if udpErr != nil {
+			log.Errorf("%s health check failed for %s: %v", CheckTypeUDPDNS, b.Addr, udpErr)
+		}
+		changed = b.recordUDPCheck(udpErr) || changed
+	}
+
+	return changed, err
 }
 
-// httpHealthCheck performs HTTP-based health check through SOCKS5 proxy
-func (b *Backend) httpHealthCheck(url string) error {
+// httpHealthCheck performs HTTP-based health check through SOCKS5 proxy, every check URL
+// has to pass or any of them depending on the configuration
+func (b *Backend) httpHealthCheck() error {
 	client, err := b.httpProxyClient()
 	if err != nil {
 		return err
 	}
 
-	// Perform HEAD request to minimize bandwidth
-	resp, err := client.Head(url)
+	urls := b.CheckConfig.checkURLs()
+	if len(urls) == 0 {
+		return errors.New("no check URL configured")
+	}
+
+	var errs []error
+	requireAny := b.CheckConfig.Require == CheckRequireAny
+	for _, url := range urls {
+		err := b.httpCheckURL(client, url)
+		switch {
+		case err == nil && requireAny:
+			return nil
+		case err != nil && !requireAny:
+			return fmt.Errorf("%s: %w", url, err)
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// httpCheckURL requests a single check URL and matches the response against the expectations
+func (b *Backend) httpCheckURL(client *http.Client, url string) error {
+	config := b.CheckConfig
+
+	req, err := http.NewRequest(config.method(), url, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range config.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	// Accept 2xx and 3xx status codes as healthy
-	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+	if !config.expectStatus(resp.StatusCode) {
+		return &CheckError{Reason: CheckUnexpectedStatus, Err: fmt.Errorf("status %d", resp.StatusCode)}
+	}
+
+	// Only read the body when it has to match
+	if config.ExpectBody == "" && config.ExpectBodyRegex == "" {
 		return nil
 	}
 
-	return err
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxCheckBodySize))
+	if err != nil {
+		return err
+	}
+
+	if config.ExpectBody != "" && !bytes.Contains(body, []byte(config.ExpectBody)) {
+		return &CheckError{Reason: CheckBodyMismatch, Err: fmt.Errorf("body does not contain %q", config.ExpectBody)}
+	}
+
+	if config.ExpectBodyRegex != "" {
+		re, err := regexp.Compile(config.ExpectBodyRegex)
+		if err != nil {
+			return err
+		}
+		if !re.Match(body) {
+			return &CheckError{Reason: CheckBodyMismatch, Err: fmt.Errorf("body does not match %q", config.ExpectBodyRegex)}
+		}
+	}
+
+	return nil
 }
 
 // httpProxyClient creates an HTTP client configured to use the SOCKS5 proxy
+// with the TLS settings of the health check
 func (b *Backend) httpProxyClient() (*http.Client, error) {
+	tlsConfig, err := b.CheckConfig.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	client := b.socks5HTTPClient(tlsConfig)
+
+	// Don't follow redirects for health checks
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return client, nil
+}
+
+// socks5HTTPClient creates an HTTP client dialing through the backend within the check
+// timeout, nil TLS settings are the defaults
+func (b *Backend) socks5HTTPClient(tlsConfig *tls.Config) *http.Client {
 	timeout := b.CheckConfig.Timeout
 	if timeout == 0 {
 		timeout = DefaultCheckTimeout
@@ -112,7 +351,7 @@ func (b *Backend) httpProxyClient() (*http.Client, error) {
 	// Configure HTTP transport with SOCKS5 dialer
 	httpTransport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return b.Socks5Conn(network, addr, int(timeout))
+			return b.socks5Conn(ctx, network, addr, int(timeout))
 		},
 		// Connection pool settings for better performance
 		MaxIdleConns:        10,
@@ -120,16 +359,13 @@ func (b *Backend) httpProxyClient() (*http.Client, error) {
 		IdleConnTimeout:     30 * time.Second,
 		// Disable compression to reduce CPU overhead
 		DisableCompression: true,
+		TLSClientConfig:    tlsConfig,
 	}
 
 	return &http.Client{
 		Transport: httpTransport,
 		Timeout:   time.Duration(timeout) * time.Second,
-		// Don't follow redirects for health checks
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}, nil
+	}
 }
 
 // socks5Client creates a SOCKS5 client with the specified timeout
@@ -140,14 +376,206 @@ func (b *Backend) socks5Client(timeout int) (*socks5.Client, error) {
 	return socks5.NewClient(string(b.Addr), b.UserName, b.Password, timeout, timeout)
 }
 
+// Socks5ReplyError is returned when the backend answers a request with a non-success reply
+type Socks5ReplyError struct {
+	Rep byte
+}
+
+func (e *Socks5ReplyError) Error() string {
+	return fmt.Sprintf("backend replied with code %#02x", e.Rep)
+}
+
+// socks5Addr is a net.Addr holding an unresolved host:port, it keeps the SOCKS5 client
+// from resolving domain targets locally since the backend is responsible for that
+type socks5Addr struct {
+	network, addr string
+}
+
+func (a socks5Addr) Network() string { return a.network }
+func (a socks5Addr) String() string  { return a.addr }
+
+// socks5Dial connects to the backend and negotiates the authentication method, the SOCKS5
+// client library dials without a connect timeout so the connection is set up here instead,
+// both the connect and the negotiation have to finish within the timeout
+func (b *Backend) socks5Dial(ctx context.Context, timeout int) (client *socks5.Client, err error) {
+	client, err = b.socks5Client(timeout)
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(client.TCPTimeout) * time.Second)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	client.TCPConn = conn.(*net.TCPConn)
+
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	if err = conn.SetDeadline(deadline); err != nil {
+		return
+	}
+
+	method := socks5.MethodNone
+	if client.UserName != "" && client.Password != "" {
+		method = socks5.MethodUsernamePassword
+	}
+
+	if _, err = socks5.NewNegotiationRequest([]byte{method}).WriteTo(conn); err != nil {
+		return
+	}
+
+	reply, err := socks5.NewNegotiationReplyFrom(conn)
+	if err != nil {
+		return
+	}
+	if reply.Method != method {
+		err = fmt.Errorf("backend did not accept method %#02x", method)
+		return
+	}
+
+	if method == socks5.MethodUsernamePassword {
+		request := socks5.NewUserPassNegotiationRequest([]byte(client.UserName), []byte(client.Password))
+		if _, err = request.WriteTo(conn); err != nil {
+			return
+		}
+
+		reply, err := socks5.NewUserPassNegotiationReplyFrom(conn)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Status != socks5.UserPassStatusSuccess {
+			return nil, socks5.ErrUserPassAuth
+		}
+	}
+
+	return client, nil
+}
+
+// socks5Request negotiates with the backend and sends a single request for the given command,
+// returns the connected client and the reply from the backend, the time until a successful
+// reply is recorded as the latency of the backend
+func (b *Backend) socks5Request(ctx context.Context, cmd byte, addr string, timeout int) (client *socks5.Client, reply *socks5.Reply, err error) {
+	start := time.Now()
+
+	if client, err = b.socks5Dial(ctx, timeout); err != nil {
+		return
+	}
+	client.RemoteAddress = socks5Addr{network: "tcp", addr: addr}
+
+	defer func() {
+		if err != nil {
+			_ = client.TCPConn.Close()
+		}
+	}()
+
+	atyp, host, port, err := socks5.ParseAddress(addr)
+	if err != nil {
+		return
+	}
+
+	if atyp == socks5.ATYPDomain {
+		host = host[1:]
+	}
+
+	if _, err = socks5.NewRequest(cmd, atyp, host, port).WriteTo(client.TCPConn); err != nil {
+		return
+	}
+
+	if reply, err = socks5.NewReplyFrom(client.TCPConn); err != nil {
+		return
+	}
+
+	if reply.Rep != socks5.RepSuccess {
+		err = &Socks5ReplyError{Rep: reply.Rep}
+		return
+	}
+
+	b.observeLatency(time.Since(start))
+	return
+}
+
 // Socks5Conn creates a connection through the SOCKS5 proxy
 func (b *Backend) Socks5Conn(network, addr string, timeout int) (cc net.Conn, err error) {
-	client, err := b.socks5Client(timeout)
+	return b.socks5Conn(context.Background(), network, addr, timeout)
+}
+
+// socks5Conn is Socks5Conn, giving up on connecting to the backend once the context is done
+func (b *Backend) socks5Conn(ctx context.Context, network, addr string, timeout int) (cc net.Conn, err error) {
+	if network != "tcp" {
+		client, err := b.socks5Client(timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Dial(network, addr)
+	}
+
+	client, _, err := b.socks5Request(ctx, socks5.CmdConnect, addr, timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	return client.Dial(network, addr)
+	// The timeout only applies to the handshake, clear it for the data stream
+	if err = client.SetDeadline(time.Time{}); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Socks5Associate opens a UDP association on the backend, returns the control connection
+// keeping the association alive and the relay address the datagrams should be sent to
+func (b *Backend) Socks5Associate(timeout int) (ctrl net.Conn, relay *net.UDPAddr, err error) {
+	client, reply, err := b.socks5Request(context.Background(), socks5.CmdUDP, "0.0.0.0:0", timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = client.Close()
+		}
+	}()
+
+	if relay, err = net.ResolveUDPAddr("udp", reply.Address()); err != nil {
+		return
+	}
+
+	// An unspecified relay address means the same host as the control connection
+	if relay.IP.IsUnspecified() {
+		relay.IP = client.TCPConn.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	// The association lives as long as the control connection, drop the handshake deadline
+	if err = client.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	return client, relay, nil
+}
+
+// Socks5Bind asks the backend to accept an incoming connection from the target, returns the
+// control connection carrying the second reply and the address the backend is listening on
+func (b *Backend) Socks5Bind(addr string, timeout int) (conn net.Conn, bound net.Addr, err error) {
+	client, reply, err := b.socks5Request(context.Background(), socks5.CmdBind, addr, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Waiting for the incoming connection is not limited by the handshake timeout
+	if err = client.SetDeadline(time.Time{}); err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+
+	return client, socks5Addr{network: "tcp", addr: reply.Address()}, nil
 }
 
 // NewBackend creates a new Backend instance with the specified configuration
@@ -155,9 +583,10 @@ func NewBackend(addr string, config BackendCheckConfig) (backend *Backend) {
 	backend = &Backend{
 		Addr:        addr,
 		CheckConfig: config,
+		Weight:      DefaultWeight,
 	}
 
-	// Set initial alive status atomically
+	// Set initial alive status of the circuit breaker
 	backend.SetAlive(config.InitialAlive)
 
 	return
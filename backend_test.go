@@ -9,13 +9,17 @@
  * File Created: 2025-10-07 11:08:41
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:23:12
+ * Last Modified: 2026-10-18 09:56:35
  */
 
 package socks5lb
 
 import (
+	"context"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBackend_Check(t *testing.T) {
@@ -29,3 +33,34 @@ func TestBackend_Check(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestBackend_Latency(t *testing.T) {
+	b := NewBackend("127.0.0.1:1080", BackendCheckConfig{})
+	assert.Zero(t, b.Latency())
+
+	b.observeLatency(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, b.Latency())
+
+	// Later samples move the average by the smoothing factor only
+	b.observeLatency(200 * time.Millisecond)
+	assert.Equal(t, 130*time.Millisecond, b.Latency())
+
+	b.observeLatency(130 * time.Millisecond)
+	assert.Equal(t, 130*time.Millisecond, b.Latency())
+}
+
+func TestBackend_Socks5ConnTimeout(t *testing.T) {
+	b := NewBackend(startHangingBackend(t), BackendCheckConfig{})
+
+	// A backend never answering the greeting is given up on after the timeout
+	start := time.Now()
+	_, err := b.Socks5Conn("tcp", "127.0.0.1:80", 1)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 3*time.Second)
+
+	// Connecting stops as soon as the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = b.socks5Conn(ctx, "tcp", "127.0.0.1:80", 1)
+	assert.ErrorIs(t, err, context.Canceled)
+}
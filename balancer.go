@@ -0,0 +1,368 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: balancer.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:51:12
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:57:19
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// StrategyRoundRobin hands out the candidates in turn
+	StrategyRoundRobin = "round_robin"
+	// StrategyRandom picks a random candidate
+	StrategyRandom = "random"
+	// StrategyWeightedRoundRobin hands out the candidates in proportion to their weight
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	// StrategyLeastConnections picks the candidate carrying the fewest active connections
+	StrategyLeastConnections = "least_connections"
+	// StrategyConsistentHash maps the hash key of a request onto a hash ring of the candidates
+	StrategyConsistentHash = "consistent_hash"
+	// StrategyClientIPHash maps the remote IP of the client onto a hash ring of the candidates
+	StrategyClientIPHash = "client_ip_hash"
+	// StrategyFastest prefers the candidate with the lowest handshake latency
+	StrategyFastest = "fastest"
+
+	// DefaultVirtualNodes is the number of points each backend occupies on the hash ring
+	DefaultVirtualNodes = 100
+)
+
+// Balancer picks one backend out of the healthy candidates for a request,
+// implementations must be safe for concurrent use
+type Balancer interface {
+	Pick(ctx context.Context, candidates []*Backend) *Backend
+}
+
+type (
+	balancerKey   struct{}
+	hashKeyKey    struct{}
+	clientAddrKey struct{}
+)
+
+// WithBalancer returns a context selecting backends with the balancer
+func WithBalancer(ctx context.Context, balancer Balancer) context.Context {
+	return context.WithValue(ctx, balancerKey{}, balancer)
+}
+
+// BalancerFrom returns the balancer of the context, nil if there is none
+func BalancerFrom(ctx context.Context) Balancer {
+	balancer, _ := ctx.Value(balancerKey{}).(Balancer)
+	return balancer
+}
+
+// WithHashKey returns a context carrying the key used by the consistent hash strategy
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyKey{}, key)
+}
+
+// HashKeyFrom returns the hash key of the context, empty if there is none
+func HashKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(hashKeyKey{}).(string)
+	return key
+}
+
+// WithClientAddr returns a context carrying the remote address of the client
+func WithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrFrom returns the remote address of the client, nil if there is none
+func ClientAddrFrom(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr
+}
+
+// clientIPFrom returns the remote IP of the client as a string, empty if it is unknown
+func clientIPFrom(ctx context.Context) string {
+	addr := ClientAddrFrom(ctx)
+	if addr == nil {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// NewBalancer creates the balancer of the named strategy, empty means weighted round-robin
+// which behaves like plain round-robin as long as all backends keep the default weight
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case StrategyRoundRobin:
+		return &RoundRobinBalancer{}, nil
+	case StrategyRandom:
+		return &RandomBalancer{}, nil
+	case "", StrategyWeightedRoundRobin:
+		return &WeightedRoundRobinBalancer{}, nil
+	case StrategyLeastConnections:
+		return &LeastConnectionsBalancer{}, nil
+	case StrategyConsistentHash:
+		return &ConsistentHashBalancer{}, nil
+	case StrategyClientIPHash:
+		return &ConsistentHashBalancer{ByClientIP: true}, nil
+	case StrategyFastest:
+		return FastestBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+}
+
+// RoundRobinBalancer hands out the candidates in turn
+type RoundRobinBalancer struct {
+	current uint64
+}
+
+func (r *RoundRobinBalancer) Pick(_ context.Context, candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	next := atomic.AddUint64(&r.current, 1)
+	return candidates[next%uint64(len(candidates))]
+}
+
+// RandomBalancer picks a random candidate
+type RandomBalancer struct{}
+
+func (RandomBalancer) Pick(_ context.Context, candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// WeightedRoundRobinBalancer is the smooth weighted round-robin used by nginx, backends
+// are handed out in proportion to their weight and interleaved instead of in bursts
+type WeightedRoundRobinBalancer struct {
+	current map[*Backend]int
+	lock    sync.Mutex
+}
+
+func (w *WeightedRoundRobinBalancer) Pick(_ context.Context, candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.current == nil {
+		w.current = make(map[*Backend]int)
+	}
+
+	// Backends which are no candidates this time, like the ones of another group, keep their
+	// state so that alternating candidate sets do not start over with the first backend
+	for backend := range w.current {
+		if backend.removed.Load() {
+			delete(w.current, backend)
+		}
+	}
+
+	var (
+		best  *Backend
+		total int
+	)
+
+	for _, candidate := range candidates {
+		weight := candidate.EffectiveWeight()
+		total += weight
+
+		w.current[candidate] += weight
+		if best == nil || w.current[candidate] > w.current[best] {
+			best = candidate
+		}
+	}
+
+	w.current[best] -= total
+	return best
+}
+
+// LeastConnectionsBalancer picks the candidate carrying the fewest active connections relative
+// to its weight, ties are broken randomly so that idle backends do not always get the same order
+type LeastConnectionsBalancer struct{}
+
+func (LeastConnectionsBalancer) Pick(_ context.Context, candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var (
+		best        *Backend
+		ties        int
+		least       int64
+		leastWeight int64
+	)
+
+	for _, candidate := range candidates {
+		active, weight := candidate.ActiveConns(), int64(candidate.EffectiveWeight())
+
+		// Compare active/weight of both backends without dividing
+		switch cmp := active*leastWeight - least*weight; {
+		case best == nil || cmp < 0:
+			best, least, leastWeight, ties = candidate, active, weight, 1
+		case cmp == 0:
+			// Reservoir sampling gives each tied candidate the same chance
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = candidate
+			}
+		}
+	}
+
+	return best
+}
+
+// FastestBalancer prefers the candidate with the lowest handshake latency, it compares two
+// random candidates only (power of two choices) so that the fastest one is not flooded
+type FastestBalancer struct{}
+
+func (FastestBalancer) Pick(_ context.Context, candidates []*Backend) *Backend {
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	first, second := candidates[i], candidates[j]
+
+	// Backends which have not been measured yet are preferred to get a sample of them
+	if second.Latency() < first.Latency() {
+		return second
+	}
+	return first
+}
+
+// hashRing places every backend on a ring of hashes multiple times, in proportion to its weight
+type hashRing struct {
+	hashes   []uint64
+	backends map[uint64]*Backend
+}
+
+// hashOf returns the 64-bit FNV-1a hash of the key
+func hashOf(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// newHashRing builds a ring with the given number of virtual nodes per unit of backend weight
+func newHashRing(backends []*Backend, replicas int) *hashRing {
+	ring := &hashRing{
+		hashes:   make([]uint64, 0, len(backends)*replicas),
+		backends: make(map[uint64]*Backend, len(backends)*replicas),
+	}
+
+	for _, backend := range backends {
+		for i := 0; i < replicas*backend.EffectiveWeight(); i++ {
+			hash := hashOf(backend.Addr + "#" + strconv.Itoa(i))
+			if _, ok := ring.backends[hash]; ok {
+				continue
+			}
+			ring.backends[hash] = backend
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	slices.Sort(ring.hashes)
+	return ring
+}
+
+// get returns the backend owning the first point at or after the hash of the key
+func (r *hashRing) get(key string) *Backend {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+
+	hash := hashOf(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+
+	return r.backends[r.hashes[idx]]
+}
+
+// ConsistentHashBalancer maps the hash key of the request onto a hash ring of the candidates,
+// the same key keeps the same backend and only few keys move when candidates change
+type ConsistentHashBalancer struct {
+	// VirtualNodes is the number of ring points per backend weight, DefaultVirtualNodes if zero
+	VirtualNodes int
+	// ByClientIP keys the ring with the remote IP of the client instead of the hash key
+	ByClientIP bool
+
+	ring      *hashRing
+	signature string
+	lock      sync.Mutex
+}
+
+func (c *ConsistentHashBalancer) Pick(ctx context.Context, candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	key := HashKeyFrom(ctx)
+	if c.ByClientIP {
+		key = clientIPFrom(ctx)
+	}
+
+	// Requests without a key are spread randomly
+	if key == "" {
+		return RandomBalancer{}.Pick(ctx, candidates)
+	}
+
+	return c.hashRing(candidates).get(key)
+}
+
+// hashRing returns the ring of the candidates, it is only rebuilt when they changed
+func (c *ConsistentHashBalancer) hashRing(candidates []*Backend) *hashRing {
+	addrs := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		addrs = append(addrs, candidate.Addr+"/"+strconv.Itoa(candidate.EffectiveWeight()))
+	}
+	slices.Sort(addrs)
+	signature := strings.Join(addrs, ",")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ring == nil || c.signature != signature {
+		replicas := c.VirtualNodes
+		if replicas <= 0 {
+			replicas = DefaultVirtualNodes
+		}
+
+		c.ring, c.signature = newHashRing(candidates, replicas), signature
+	}
+
+	return c.ring
+}
@@ -0,0 +1,276 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: balancer_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:51:12
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:57:19
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBackends creates alive backends with the given weights
+func newTestBackends(weights ...int) (backends []*Backend) {
+	for i, weight := range weights {
+		backend := NewBackend(fmt.Sprintf("10.0.0.%d:1080", i+1), BackendCheckConfig{InitialAlive: true})
+		backend.Weight = weight
+		backends = append(backends, backend)
+	}
+	return
+}
+
+// countPicks picks n times and counts the picks per backend address
+func countPicks(balancer Balancer, ctx context.Context, candidates []*Backend, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[balancer.Pick(ctx, candidates).Addr]++
+	}
+	return counts
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, strategy := range []string{"", StrategyRoundRobin, StrategyRandom, StrategyWeightedRoundRobin,
+		StrategyLeastConnections, StrategyConsistentHash, StrategyClientIPHash, StrategyFastest} {
+		balancer, err := NewBalancer(strategy)
+		assert.NoError(t, err)
+		assert.NotNil(t, balancer)
+		assert.Nil(t, balancer.Pick(context.Background(), nil))
+	}
+
+	_, err := NewBalancer("fastest_guess")
+	assert.Error(t, err)
+
+	server, err := NewServer(newTestPool(), ServerConfig{})
+	assert.NoError(t, err)
+	assert.NotNil(t, server)
+
+	config := ServerConfig{}
+	config.HTTPProxy.Strategy = "unknown"
+	_, err = NewServer(newTestPool(), config)
+	assert.Error(t, err)
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	backends := newTestBackends(1, 1, 1)
+	counts := countPicks(&RoundRobinBalancer{}, context.Background(), backends, 30)
+
+	for _, backend := range backends {
+		assert.Equal(t, 10, counts[backend.Addr])
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	backends := newTestBackends(1, 1)
+	counts := countPicks(RandomBalancer{}, context.Background(), backends, 1000)
+
+	assert.Len(t, counts, 2)
+	assert.Equal(t, 1000, counts[backends[0].Addr]+counts[backends[1].Addr])
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	backends := newTestBackends(5, 1, 1)
+	balancer := &WeightedRoundRobinBalancer{}
+
+	// The smooth variant interleaves the heavy backend with the light ones
+	var order []string
+	for i := 0; i < 7; i++ {
+		order = append(order, balancer.Pick(context.Background(), backends).Addr)
+	}
+
+	a, b, c := backends[0].Addr, backends[1].Addr, backends[2].Addr
+	assert.Equal(t, []string{a, a, b, a, c, a, a}, order)
+
+	counts := countPicks(balancer, context.Background(), backends, 700)
+	assert.Equal(t, 500, counts[a])
+	assert.Equal(t, 100, counts[b])
+	assert.Equal(t, 100, counts[c])
+}
+
+func TestWeightedRoundRobinBalancer_AlternatingCandidates(t *testing.T) {
+	backends := newTestBackends(1, 1, 1, 1)
+	first, second := backends[:2], backends[2:]
+	balancer := &WeightedRoundRobinBalancer{}
+
+	// Requests alternating between two groups still reach every backend of both
+	counts := make(map[*Backend]int)
+	for i := 0; i < 100; i++ {
+		candidates := first
+		if i%2 == 1 {
+			candidates = second
+		}
+		counts[balancer.Pick(context.Background(), candidates)]++
+	}
+
+	for _, backend := range backends {
+		assert.Equal(t, 25, counts[backend])
+	}
+
+	// Only the state of backends which left the pool is dropped
+	pool := newTestPool(backends...)
+	assert.NoError(t, pool.Remove(backends[0].Addr))
+	balancer.Pick(context.Background(), second)
+	assert.NotContains(t, balancer.current, backends[0])
+	assert.Contains(t, balancer.current, backends[1])
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	backends := newTestBackends(1, 1, 1)
+	backends[0].acquire()
+	backends[0].acquire()
+	backends[2].acquire()
+
+	balancer := LeastConnectionsBalancer{}
+	assert.Equal(t, backends[1], balancer.Pick(context.Background(), backends))
+
+	backends[1].acquire()
+	backends[1].acquire()
+	assert.Equal(t, backends[2], balancer.Pick(context.Background(), backends))
+
+	// Ties are spread over all the idle backends
+	backends[0].release()
+	backends[0].release()
+	backends[1].release()
+	backends[1].release()
+	backends[2].release()
+	counts := countPicks(balancer, context.Background(), backends, 300)
+	assert.Len(t, counts, 3)
+
+	// A heavier backend is expected to carry proportionally more connections
+	weighted := newTestBackends(3, 1)
+	weighted[0].acquire()
+	weighted[0].acquire()
+	weighted[1].acquire()
+	assert.Equal(t, weighted[0], balancer.Pick(context.Background(), weighted))
+
+	weighted[0].acquire()
+	counts = countPicks(balancer, context.Background(), weighted, 100)
+	assert.Len(t, counts, 2)
+}
+
+func TestFastestBalancer(t *testing.T) {
+	backends := newTestBackends(1, 1, 1)
+	backends[0].observeLatency(10 * time.Millisecond)
+	backends[1].observeLatency(50 * time.Millisecond)
+	backends[2].observeLatency(200 * time.Millisecond)
+
+	balancer := FastestBalancer{}
+	assert.Equal(t, backends[0], balancer.Pick(context.Background(), backends[:1]))
+
+	// The slowest backend never wins a comparison, the fastest wins most of them
+	counts := countPicks(balancer, context.Background(), backends, 3000)
+	assert.Zero(t, counts[backends[2].Addr])
+	assert.Greater(t, counts[backends[0].Addr], counts[backends[1].Addr])
+	assert.Positive(t, counts[backends[1].Addr])
+
+	// A backend without samples is tried before the measured ones
+	fresh := NewBackend("10.0.0.9:1080", BackendCheckConfig{InitialAlive: true})
+	assert.Equal(t, fresh, balancer.Pick(context.Background(), []*Backend{backends[0], fresh}))
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	backends := newTestBackends(1, 1, 1, 1, 1)
+	balancer := &ConsistentHashBalancer{}
+
+	owners := make(map[string]*Backend)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("host-%d.example.com", i)
+		owner := balancer.Pick(WithHashKey(context.Background(), key), backends)
+		assert.Equal(t, owner, balancer.Pick(WithHashKey(context.Background(), key), backends))
+		owners[key] = owner
+	}
+
+	// Removing a backend only moves the keys it owned
+	removed := backends[2]
+	remaining := append(append([]*Backend{}, backends[:2]...), backends[3:]...)
+	for key, owner := range owners {
+		moved := balancer.Pick(WithHashKey(context.Background(), key), remaining)
+		if owner != removed {
+			assert.Equal(t, owner, moved, key)
+		} else {
+			assert.NotEqual(t, removed, moved, key)
+		}
+	}
+}
+
+func TestClientIPHashBalancer(t *testing.T) {
+	pool := newTestPool(newTestBackends(1, 1, 1, 1)...)
+	balancer, err := NewBalancer(StrategyClientIPHash)
+	assert.NoError(t, err)
+
+	clientCtx := func(i, port int) context.Context {
+		addr := &net.TCPAddr{IP: net.IPv4(172, 16, byte(i/256), byte(i%256)), Port: port}
+		return WithClientAddr(WithHashKey(context.Background(), "example.com"), addr)
+	}
+
+	// The client IP decides, neither the port nor the destination does
+	owners := make(map[int]*Backend)
+	for i := 0; i < 1000; i++ {
+		owners[i] = pool.Pick(clientCtx(i, 10000), balancer)
+		assert.Equal(t, owners[i], pool.Pick(clientCtx(i, 20000), balancer))
+	}
+
+	// Clients only move to a backend joining the pool
+	added := NewBackend("10.0.0.100:1080", BackendCheckConfig{InitialAlive: true})
+	assert.NoError(t, pool.Add(added))
+
+	moved := 0
+	for i, owner := range owners {
+		if picked := pool.Pick(clientCtx(i, 10000), balancer); picked != owner {
+			assert.Equal(t, added, picked)
+			moved++
+		}
+	}
+	assert.Positive(t, moved)
+	assert.Less(t, moved, 400)
+
+	// Removing it again restores the previous mapping
+	assert.NoError(t, pool.Remove(added.Addr))
+	for i, owner := range owners {
+		assert.Equal(t, owner, pool.Pick(clientCtx(i, 10000), balancer))
+	}
+
+	// Clients of a removed backend move, everyone else stays
+	removed := owners[0]
+	assert.NoError(t, pool.Remove(removed.Addr))
+	for i, owner := range owners {
+		picked := pool.Pick(clientCtx(i, 10000), balancer)
+		if owner == removed {
+			assert.NotEqual(t, removed, picked)
+		} else {
+			assert.Equal(t, owner, picked)
+		}
+	}
+}
+
+func TestPool_Pick(t *testing.T) {
+	backends := newTestBackends(3, 1)
+	pool := newTestPool(backends...)
+
+	balancer := &WeightedRoundRobinBalancer{}
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[pool.Pick(context.Background(), balancer).Addr]++
+	}
+
+	assert.Equal(t, 30, counts[backends[0].Addr])
+	assert.Equal(t, 10, counts[backends[1].Addr])
+
+	backends[0].SetAlive(false)
+	assert.Equal(t, backends[1], pool.Pick(context.Background(), balancer))
+	assert.Nil(t, pool.Pick(context.Background(), balancer, backends[1]))
+}
@@ -0,0 +1,261 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: breaker.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:07:37
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:07:37
+ */
+
+package socks5lb
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultOpenTimeout is how long a tripped breaker stays open before trial connections
+	DefaultOpenTimeout = 30 * time.Second
+	// DefaultMaxOpenTimeout caps the back-off which doubles with every failed trial
+	DefaultMaxOpenTimeout = 5 * time.Minute
+	// DefaultHalfOpenTrials is the number of trial connections of a half-open breaker
+	DefaultHalfOpenTrials = 1
+)
+
+// BreakerState is the state of the circuit breaker of a backend
+type BreakerState int32
+
+const (
+	// BreakerOpen keeps the backend out of rotation, it is the zero value so that
+	// new backends wait for their first health check
+	BreakerOpen BreakerState = iota
+	// BreakerHalfOpen allows a few trial connections to decide whether the backend recovered
+	BreakerHalfOpen
+	// BreakerClosed lets all connections through
+	BreakerClosed
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// BreakerStatus is a snapshot of a circuit breaker
+type BreakerStatus struct {
+	State       BreakerState `json:"state"`
+	Since       time.Time    `json:"since"`
+	Trips       uint         `json:"trips"`                   // times the breaker opened because of failures
+	Trials      int          `json:"trials"`                  // trial connections in flight while half-open
+	NextRetryAt *time.Time   `json:"next_retry_at,omitempty"` // when trial connections start, none until a health check passes
+}
+
+// circuitBreaker decides whether a backend takes connections, it is opened by failed health
+// checks until one passes, or tripped by failing connections for a back-off period after which
+// it lets a few trial connections through and closes again once one of them succeeds, passing
+// health checks do not close a tripped breaker
+type circuitBreaker struct {
+	state   BreakerState
+	since   time.Time
+	retryAt time.Time     // zero while the breaker waits for a health check
+	backoff time.Duration // open period of the last trip, doubled by failed trials
+	trials  int           // trial connections allowed while half-open
+	flight  int           // trial connections handed out while half-open
+	trips   uint
+
+	lock sync.Mutex
+}
+
+// set moves to the state, the caller must hold the lock
+func (c *circuitBreaker) set(state BreakerState) {
+	if c.state != state {
+		c.state, c.since = state, time.Now()
+	}
+}
+
+// advance moves an open breaker to half-open once its back-off elapsed, the caller must hold the lock
+func (c *circuitBreaker) advance() {
+	if c.state == BreakerOpen && !c.retryAt.IsZero() && !time.Now().Before(c.retryAt) {
+		c.set(BreakerHalfOpen)
+		c.flight = 0
+	}
+}
+
+// tripped reports whether the breaker waits for trial connections, the caller must hold the lock
+func (c *circuitBreaker) tripped() bool {
+	return c.state == BreakerHalfOpen || (c.state == BreakerOpen && !c.retryAt.IsZero())
+}
+
+// available reports whether the breaker would let a connection through
+func (c *circuitBreaker) available() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.advance()
+	return c.state == BreakerClosed || (c.state == BreakerHalfOpen && c.flight < c.trials)
+}
+
+// allow lets a connection through, while half-open it takes one of the trial slots
+func (c *circuitBreaker) allow() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.advance()
+	switch c.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if c.flight < c.trials {
+			c.flight++
+			return true
+		}
+	}
+
+	return false
+}
+
+// close lets all connections through again and forgets the back-off, a tripped
+// breaker is left alone since only its trial connections may close it
+func (c *circuitBreaker) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tripped() {
+		return
+	}
+
+	c.set(BreakerClosed)
+	c.retryAt, c.backoff, c.flight = time.Time{}, 0, 0
+}
+
+// hold opens the breaker until a health check closes it
+func (c *circuitBreaker) hold() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.set(BreakerOpen)
+	c.retryAt, c.flight = time.Time{}, 0
+}
+
+// trip opens the breaker for the back-off period, half-open follows with the given trials
+func (c *circuitBreaker) trip(backoff time.Duration, trials int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.trips++
+	c.set(BreakerOpen)
+	c.backoff, c.trials, c.flight = backoff, trials, 0
+	c.retryAt = time.Now().Add(backoff)
+}
+
+// trial records the outcome of a trial connection, returns the back-off of a failed trial
+// to reopen with, zero if the breaker was not half-open or the trial succeeded
+func (c *circuitBreaker) trial(ok bool) (backoff time.Duration, trials int, halfOpen bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != BreakerHalfOpen {
+		return 0, 0, false
+	}
+
+	if ok {
+		c.set(BreakerClosed)
+		c.retryAt, c.backoff, c.flight = time.Time{}, 0, 0
+		return 0, 0, true
+	}
+
+	return c.backoff * 2, c.trials, true
+}
+
+// status returns a snapshot of the breaker
+func (c *circuitBreaker) status() (status BreakerStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.advance()
+	status = BreakerStatus{State: c.state, Since: c.since, Trips: c.trips}
+	if c.state == BreakerHalfOpen {
+		status.Trials = c.flight
+	}
+	if c.state == BreakerOpen && !c.retryAt.IsZero() {
+		retryAt := c.retryAt
+		status.NextRetryAt = &retryAt
+	}
+
+	return
+}
+
+// Breaker returns a snapshot of the circuit breaker of the backend
+func (b *Backend) Breaker() BreakerStatus {
+	return b.breaker.status()
+}
+
+// Trip opens the circuit breaker of the backend for the open timeout of the configuration
+func (b *Backend) Trip(config PassiveHealthConfig) {
+	b.breaker.trip(config.openTimeout(), config.halfOpenTrials())
+}
+
+// allow takes the connection slot of the backend, false if the breaker does not let it through
+func (b *Backend) allow() bool {
+	return b.breaker.allow()
+}
+
+// reportTrial closes the breaker of a half-open backend after a successful trial connection,
+// or opens it again for a doubled back-off after a failed one, returns whether it was a trial
+func (b *Backend) reportTrial(ok bool, config PassiveHealthConfig) (trial bool) {
+	backoff, trials, halfOpen := b.breaker.trial(ok)
+	if !halfOpen {
+		return false
+	}
+
+	if ok {
+		log.Infof("backend %s passed its trial connection, closing the circuit breaker", b.Addr)
+		return true
+	}
+
+	backoff = min(max(backoff, config.openTimeout()), config.maxOpenTimeout())
+	log.Warnf("backend %s failed its trial connection, opening the circuit breaker for %v", b.Addr, backoff)
+	b.breaker.trip(backoff, trials)
+	return true
+}
+
+// openTimeout returns the first back-off of a tripped breaker
+func (c PassiveHealthConfig) openTimeout() time.Duration {
+	if c.OpenTimeout == 0 {
+		return DefaultOpenTimeout
+	}
+	return time.Duration(c.OpenTimeout) * time.Second
+}
+
+// maxOpenTimeout returns the longest back-off of a breaker failing its trials
+func (c PassiveHealthConfig) maxOpenTimeout() time.Duration {
+	if c.MaxOpenTimeout == 0 {
+		return max(DefaultMaxOpenTimeout, c.openTimeout())
+	}
+	return max(time.Duration(c.MaxOpenTimeout)*time.Second, c.openTimeout())
+}
+
+// halfOpenTrials returns the number of trial connections of a half-open breaker
+func (c PassiveHealthConfig) halfOpenTrials() int {
+	if c.HalfOpenTrials == 0 {
+		return DefaultHalfOpenTrials
+	}
+	return int(c.HalfOpenTrials)
+}
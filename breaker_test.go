@@ -0,0 +1,150 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: breaker_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:07:37
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:07:37
+ */
+
+package socks5lb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackend_BreakerHealthCheck(t *testing.T) {
+	// New backends wait for their first health check
+	backend := &Backend{Addr: "127.0.0.1:1080"}
+	assert.False(t, backend.Alive())
+	assert.Equal(t, BreakerOpen, backend.Breaker().State)
+	assert.Nil(t, backend.Breaker().NextRetryAt)
+
+	backend.SetAlive(true)
+	assert.True(t, backend.Alive())
+	assert.Equal(t, BreakerClosed, backend.Breaker().State)
+
+	// Failed health checks keep the breaker open without trial connections
+	backend.SetAlive(false)
+	assert.False(t, backend.allow())
+	assert.Nil(t, backend.Breaker().NextRetryAt)
+	assert.Zero(t, backend.Breaker().Trips)
+}
+
+func TestBackend_BreakerHalfOpen(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	config := PassiveHealthConfig{}
+
+	backend.breaker.trip(20*time.Millisecond, 1)
+	assert.False(t, backend.Alive())
+	status := backend.Breaker()
+	assert.Equal(t, BreakerOpen, status.State)
+	assert.Equal(t, uint(1), status.Trips)
+	assert.NotNil(t, status.NextRetryAt)
+
+	// Half-open hands out a single trial connection
+	assert.Eventually(t, backend.Alive, time.Second, 5*time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, backend.Breaker().State)
+	assert.True(t, backend.allow())
+	assert.False(t, backend.allow())
+	assert.False(t, backend.Alive())
+	assert.Equal(t, 1, backend.Breaker().Trials)
+
+	// A failed trial opens the breaker again for at least the open timeout
+	backend.reportTrial(false, config)
+	status = backend.Breaker()
+	assert.Equal(t, BreakerOpen, status.State)
+	assert.Equal(t, uint(2), status.Trips)
+	assert.WithinDuration(t, time.Now().Add(DefaultOpenTimeout), *status.NextRetryAt, time.Second)
+
+	// A successful trial closes it
+	backend.breaker.trip(10*time.Millisecond, 1)
+	assert.Eventually(t, backend.allow, time.Second, 5*time.Millisecond)
+	backend.reportTrial(true, config)
+	assert.Equal(t, BreakerClosed, backend.Breaker().State)
+	assert.True(t, backend.Alive())
+
+	// Outcomes of closed breakers change nothing
+	backend.reportTrial(false, config)
+	assert.Equal(t, BreakerClosed, backend.Breaker().State)
+}
+
+func TestBackend_BreakerTripOutlastsHealthChecks(t *testing.T) {
+	// Unchecked backends are set to their initial state by every check
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	backend.Trip(PassiveHealthConfig{OpenTimeout: 300})
+	assert.NoError(t, backend.Check())
+	assert.Equal(t, BreakerOpen, backend.Breaker().State)
+	assert.NotNil(t, backend.Breaker().NextRetryAt)
+
+	// Passing checks leave a half-open breaker to its trial connections
+	backend.breaker.trip(10*time.Millisecond, 1)
+	assert.Eventually(t, func() bool { return backend.Breaker().State == BreakerHalfOpen }, time.Second, 5*time.Millisecond)
+	backend.SetAlive(true)
+	assert.Equal(t, BreakerHalfOpen, backend.Breaker().State)
+
+	assert.True(t, backend.allow())
+	backend.reportTrial(true, PassiveHealthConfig{})
+	assert.Equal(t, BreakerClosed, backend.Breaker().State)
+
+	// A failed check takes over the tripped breaker, the next passing one closes it
+	backend.breaker.trip(time.Minute, 1)
+	backend.SetAlive(false)
+	assert.Nil(t, backend.Breaker().NextRetryAt)
+	backend.SetAlive(true)
+	assert.Equal(t, BreakerClosed, backend.Breaker().State)
+}
+
+func TestPassiveHealthConfig_Backoff(t *testing.T) {
+	config := PassiveHealthConfig{OpenTimeout: 10, MaxOpenTimeout: 40, HalfOpenTrials: 2}
+	assert.Equal(t, 10*time.Second, config.openTimeout())
+	assert.Equal(t, 40*time.Second, config.maxOpenTimeout())
+	assert.Equal(t, 2, config.halfOpenTrials())
+
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	backend.Trip(config)
+	assert.Equal(t, 10*time.Second, backend.breaker.backoff)
+
+	// The back-off doubles with failed trials up to the maximum
+	for _, expected := range []time.Duration{20 * time.Second, 40 * time.Second, 40 * time.Second} {
+		backend.breaker.lock.Lock()
+		backend.breaker.retryAt = time.Now()
+		backend.breaker.lock.Unlock()
+
+		assert.True(t, backend.allow())
+		assert.True(t, backend.allow())
+		backend.reportTrial(false, config)
+		assert.Equal(t, expected, backend.breaker.backoff)
+	}
+}
+
+func TestBackend_BreakerJSON(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	backend.breaker.trip(time.Minute, 1)
+
+	data, err := json.Marshal(backend)
+	assert.NoError(t, err)
+
+	var decoded struct {
+		Alive   bool `json:"alive"`
+		Breaker struct {
+			State       string     `json:"state"`
+			Trips       uint       `json:"trips"`
+			NextRetryAt *time.Time `json:"next_retry_at"`
+		} `json:"breaker"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.False(t, decoded.Alive)
+	assert.Equal(t, "open", decoded.Breaker.State)
+	assert.Equal(t, uint(1), decoded.Breaker.Trips)
+	assert.NotNil(t, decoded.Breaker.NextRetryAt)
+}
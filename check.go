@@ -0,0 +1,440 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: check.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:19:30
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:24:01
+ */
+
+package socks5lb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/txthinking/socks5"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// CheckTypeHTTP fetches the check URL through the backend, the default with a check URL
+	CheckTypeHTTP = "http"
+	// CheckTypeSocks5 negotiates with the backend and optionally connects to the check target
+	CheckTypeSocks5 = "socks5"
+	// CheckTypeTCP connects to the check target through the backend, sends and expects raw data
+	CheckTypeTCP = "tcp"
+	// CheckTypeUDPDNS resolves a name with a DNS resolver through a UDP association of the backend
+	CheckTypeUDPDNS = "udp_dns"
+)
+
+const (
+	// CheckUnreachable means the backend could not be reached or spoke no SOCKS5
+	CheckUnreachable = "unreachable"
+	// CheckAuthRejected means the backend rejected the authentication method or the credentials
+	CheckAuthRejected = "auth_rejected"
+	// CheckConnectRefused means the backend refused to connect to the check target
+	CheckConnectRefused = "connect_refused"
+	// CheckUnexpectedStatus means the check URL answered with a status code not expected
+	CheckUnexpectedStatus = "unexpected_status"
+	// CheckBodyMismatch means the body of the check URL did not match the expectation
+	CheckBodyMismatch = "body_mismatch"
+	// CheckResponseMismatch means the check target did not answer as expected in time
+	CheckResponseMismatch = "response_mismatch"
+	// CheckUDPUnsupported means the backend refused to open a UDP association
+	CheckUDPUnsupported = "udp_unsupported"
+	// CheckNoAnswer means the resolver did not answer through the UDP relay in time
+	CheckNoAnswer = "no_answer"
+)
+
+const (
+	// DefaultCheckResolver is the DNS resolver queried by the udp_dns check
+	DefaultCheckResolver = "8.8.8.8:53"
+	// DefaultCheckQueryName is the name resolved by the udp_dns check
+	DefaultCheckQueryName = "example.com"
+)
+
+const (
+	// CheckRequireAll fails the http check when one of its URLs fails
+	CheckRequireAll = "all"
+	// CheckRequireAny passes the http check when one of its URLs passes
+	CheckRequireAny = "any"
+)
+
+// DNSCheckConfig is the query of the udp_dns check
+type DNSCheckConfig struct {
+	Resolver     string `yaml:"resolver" json:"resolver"`           // host:port of the resolver, default 8.8.8.8:53
+	Name         string `yaml:"name" json:"name"`                   // name resolved for an A record, default example.com
+	ExpectAnswer string `yaml:"expect_answer" json:"expect_answer"` // address the answer must contain, optional
+}
+
+// MaxCheckBodySize is the number of bytes of a response body matched by the http and tcp checks
+const MaxCheckBodySize = 1 << 20
+
+// CheckTLSConfig controls how the http check verifies HTTPS check URLs
+type CheckTLSConfig struct {
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name" json:"server_name"` // name verified instead of the host of the URL
+	CAFile             string `yaml:"ca_file" json:"ca_file"`         // PEM certificates trusted instead of the system ones
+}
+
+// config returns the TLS configuration of the http check
+func (c CheckTLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// CheckError is a health check failure classified by its cause
+type CheckError struct {
+	Reason string
+	Err    error
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// checkType returns the check type of the backend, empty when it is not checked at all
+func (c BackendCheckConfig) checkType() string {
+	if c.Type == "" && len(c.checkURLs()) > 0 {
+		return CheckTypeHTTP
+	}
+	return c.Type
+}
+
+// checkURLs returns all URLs of the http check
+func (c BackendCheckConfig) checkURLs() (urls []string) {
+	if c.CheckURL != "" {
+		urls = append(urls, c.CheckURL)
+	}
+	return append(urls, c.CheckURLs...)
+}
+
+// method returns the request method of the http check
+func (c BackendCheckConfig) method() string {
+	switch {
+	case c.Method != "":
+		return strings.ToUpper(c.Method)
+	case c.ExpectBody != "" || c.ExpectBodyRegex != "":
+		return http.MethodGet
+	default:
+		return http.MethodHead
+	}
+}
+
+// expectStatus reports whether the status code passes the http check
+func (c BackendCheckConfig) expectStatus(code int) bool {
+	if len(c.ExpectStatus) == 0 {
+		return code >= 200 && code < 400
+	}
+	return slices.Contains(c.ExpectStatus, code)
+}
+
+// timeout returns the timeout of a single health check
+func (c BackendCheckConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultCheckTimeout * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// socks5HealthCheck performs the SOCKS5 greeting and authentication with the backend, and a
+// CONNECT to the check target if there is one, the time until success is recorded as its latency
+func (b *Backend) socks5HealthCheck() (err error) {
+	timeout, start := b.CheckConfig.timeout(), time.Now()
+
+	conn, err := net.DialTimeout("tcp", b.Addr, timeout)
+	if err != nil {
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(start.Add(timeout)); err != nil {
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+
+	method := socks5.MethodNone
+	if b.UserName != "" && b.Password != "" {
+		method = socks5.MethodUsernamePassword
+	}
+
+	if _, err = socks5.NewNegotiationRequest([]byte{method}).WriteTo(conn); err != nil {
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+
+	reply, err := socks5.NewNegotiationReplyFrom(conn)
+	if err != nil {
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+	if reply.Method != method {
+		return &CheckError{Reason: CheckAuthRejected, Err: fmt.Errorf("method %#02x not accepted", method)}
+	}
+
+	if method == socks5.MethodUsernamePassword {
+		request := socks5.NewUserPassNegotiationRequest([]byte(b.UserName), []byte(b.Password))
+		if _, err = request.WriteTo(conn); err != nil {
+			return &CheckError{Reason: CheckUnreachable, Err: err}
+		}
+
+		reply, err := socks5.NewUserPassNegotiationReplyFrom(conn)
+		if err != nil {
+			return &CheckError{Reason: CheckUnreachable, Err: err}
+		}
+		if reply.Status != socks5.UserPassStatusSuccess {
+			return &CheckError{Reason: CheckAuthRejected, Err: socks5.ErrUserPassAuth}
+		}
+	}
+
+	// Without a target the negotiation alone shows the backend works
+	if target := b.CheckConfig.CheckTarget; target != "" {
+		atyp, host, port, err := socks5.ParseAddress(target)
+		if err != nil {
+			return err
+		}
+		if atyp == socks5.ATYPDomain {
+			host = host[1:]
+		}
+
+		if _, err = socks5.NewRequest(socks5.CmdConnect, atyp, host, port).WriteTo(conn); err != nil {
+			return &CheckError{Reason: CheckUnreachable, Err: err}
+		}
+
+		reply, err := socks5.NewReplyFrom(conn)
+		if err != nil {
+			return &CheckError{Reason: CheckUnreachable, Err: err}
+		}
+		if reply.Rep != socks5.RepSuccess {
+			return &CheckError{Reason: CheckConnectRefused, Err: &Socks5ReplyError{Rep: reply.Rep}}
+		}
+	}
+
+	b.observeLatency(time.Since(start))
+	return
+}
+
+// socks5CheckError classifies an error of opening a connection through the backend
+func socks5CheckError(err error) error {
+	var replyErr *Socks5ReplyError
+	switch {
+	case errors.As(err, &replyErr):
+		return &CheckError{Reason: CheckConnectRefused, Err: err}
+	case errors.Is(err, socks5.ErrUserPassAuth):
+		return &CheckError{Reason: CheckAuthRejected, Err: err}
+	default:
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+}
+
+// tcpHealthCheck connects to the check target through the backend, sends the payload if
+// there is one and reads until the response matches the expectations within the timeout
+func (b *Backend) tcpHealthCheck() (err error) {
+	config := b.CheckConfig
+	if config.CheckTarget == "" {
+		return errors.New("no check target configured")
+	}
+
+	var re *regexp.Regexp
+	if config.ExpectRegex != "" {
+		if re, err = regexp.Compile(config.ExpectRegex); err != nil {
+			return
+		}
+	}
+
+	start := time.Now()
+	conn, err := b.Socks5Conn("tcp", config.CheckTarget, int(config.Timeout))
+	if err != nil {
+		return socks5CheckError(err)
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(start.Add(config.timeout())); err != nil {
+		return
+	}
+
+	if config.Send != "" {
+		if _, err = conn.Write([]byte(config.Send)); err != nil {
+			return
+		}
+	}
+
+	// The connection itself is enough without expectations
+	if config.Expect == "" && re == nil {
+		return
+	}
+
+	matches := func(response []byte) bool {
+		if config.Expect != "" && !bytes.HasPrefix(response, []byte(config.Expect)) {
+			return false
+		}
+		return re == nil || re.Match(response)
+	}
+
+	// Read until the response matches, the target closes the connection or the timeout elapses
+	var response []byte
+	buf := make([]byte, 4096)
+	for len(response) < MaxCheckBodySize {
+		n, err := conn.Read(buf)
+		response = append(response, buf[:n]...)
+		if matches(response) {
+			return nil
+		}
+
+		// A response not starting with the prefix will never match
+		if config.Expect != "" && len(response) >= len(config.Expect) && !bytes.HasPrefix(response, []byte(config.Expect)) {
+			break
+		}
+
+		if err != nil {
+			return &CheckError{Reason: CheckResponseMismatch, Err: fmt.Errorf("%q after %w", response, err)}
+		}
+	}
+
+	return &CheckError{Reason: CheckResponseMismatch, Err: fmt.Errorf("unexpected response %q", response)}
+}
+
+// dnsHealthCheck resolves the name with the resolver through a UDP association of the backend
+// and validates the answer
+func (b *Backend) dnsHealthCheck() (err error) {
+	var config DNSCheckConfig
+	if b.CheckConfig.DNS != nil {
+		config = *b.CheckConfig.DNS
+	}
+
+	resolver, name := config.Resolver, config.Name
+	if resolver == "" {
+		resolver = DefaultCheckResolver
+	}
+	if name == "" {
+		name = DefaultCheckQueryName
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return
+	}
+
+	atyp, host, port, err := socks5.ParseAddress(resolver)
+	if err != nil {
+		return
+	}
+	if atyp == socks5.ATYPDomain {
+		host = host[1:]
+	}
+
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	ctrl, relay, err := b.Socks5Associate(int(b.CheckConfig.Timeout))
+	if err != nil {
+		var replyErr *Socks5ReplyError
+		if errors.As(err, &replyErr) {
+			return &CheckError{Reason: CheckUDPUnsupported, Err: err}
+		}
+		return socks5CheckError(err)
+	}
+	defer ctrl.Close()
+
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(start.Add(b.CheckConfig.timeout())); err != nil {
+		return
+	}
+
+	if _, err = conn.Write(socks5.NewDatagram(atyp, host, port, query).Bytes()); err != nil {
+		return &CheckError{Reason: CheckUnreachable, Err: err}
+	}
+
+	// Skip datagrams which are no answer to the query
+	buf := make([]byte, MaxUDPPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return &CheckError{Reason: CheckNoAnswer, Err: err}
+		}
+
+		datagram, err := socks5.NewDatagramFromBytes(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		var answer dnsmessage.Message
+		if answer.Unpack(datagram.Data) != nil || answer.ID != id || !answer.Response {
+			continue
+		}
+
+		return validateDNSAnswer(answer, config.ExpectAnswer)
+	}
+}
+
+// validateDNSAnswer checks that the answer resolved the name, to the expected address if there is one
+func validateDNSAnswer(answer dnsmessage.Message, expect string) error {
+	if answer.RCode != dnsmessage.RCodeSuccess {
+		return &CheckError{Reason: CheckResponseMismatch, Err: fmt.Errorf("resolver answered %v", answer.RCode)}
+	}
+
+	var addrs []string
+	for _, resource := range answer.Answers {
+		if a, ok := resource.Body.(*dnsmessage.AResource); ok {
+			addrs = append(addrs, net.IP(a.A[:]).String())
+		}
+	}
+
+	switch {
+	case len(addrs) == 0:
+		return &CheckError{Reason: CheckResponseMismatch, Err: errors.New("no address in the answer")}
+	case expect != "" && !slices.Contains(addrs, expect):
+		return &CheckError{Reason: CheckResponseMismatch, Err: fmt.Errorf("answer %v does not contain %s", addrs, expect)}
+	}
+
+	return nil
+}
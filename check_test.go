@@ -0,0 +1,309 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: check_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:19:30
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:24:01
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// checkReason returns the classification of a health check error
+func checkReason(err error) string {
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		return checkErr.Reason
+	}
+	return ""
+}
+
+func TestBackend_Socks5HealthCheck(t *testing.T) {
+	addr := startSocks5Backend(t, "backend", "secret")
+
+	backend := NewBackend(addr, BackendCheckConfig{Type: CheckTypeSocks5, Timeout: 2})
+	backend.UserName, backend.Password = "backend", "secret"
+	assert.NoError(t, backend.Check())
+	assert.True(t, backend.Alive())
+	assert.NotZero(t, backend.Latency())
+
+	// The CONNECT to the target is optional
+	backend.CheckConfig.CheckTarget = startEchoServer(t)
+	assert.NoError(t, backend.Check())
+
+	backend.CheckConfig.CheckTarget = freeAddr(t)
+	assert.Equal(t, CheckConnectRefused, checkReason(backend.Check()))
+
+	// Wrong or missing credentials are rejected
+	rejected := NewBackend(addr, BackendCheckConfig{Type: CheckTypeSocks5, Timeout: 2})
+	assert.Equal(t, CheckAuthRejected, checkReason(rejected.Check()))
+	assert.False(t, rejected.Alive())
+
+	rejected.UserName, rejected.Password = "backend", "wrong"
+	assert.Equal(t, CheckAuthRejected, checkReason(rejected.Check()))
+
+	unreachable := NewBackend(freeAddr(t), BackendCheckConfig{Type: CheckTypeSocks5, Timeout: 2})
+	assert.Equal(t, CheckUnreachable, checkReason(unreachable.Check()))
+	assert.Contains(t, unreachable.Health().History[0].Reason, CheckUnreachable)
+}
+
+func TestBackendCheckConfig_Type(t *testing.T) {
+	assert.Equal(t, "", BackendCheckConfig{}.checkType())
+	assert.Equal(t, CheckTypeHTTP, BackendCheckConfig{CheckURL: "https://example.com"}.checkType())
+	assert.Equal(t, CheckTypeSocks5, BackendCheckConfig{Type: CheckTypeSocks5}.checkType())
+
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{Type: "unknown"})
+	assert.Error(t, backend.Check())
+}
+
+func TestBackend_HTTPHealthCheck(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/status":
+			assert.Equal(t, http.MethodGet, r.Method)
+			assert.Equal(t, "socks5lb", r.Header.Get("X-Check"))
+			_, _ = w.Write([]byte(`{"status":"ok","version":3}`))
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	addr := startSocks5Backend(t, "", "")
+	backend := NewBackend(addr, BackendCheckConfig{CheckURL: target.URL + "/", Timeout: 2})
+	assert.NoError(t, backend.Check())
+
+	// Client and server errors fail the check
+	backend.CheckConfig.CheckURL = target.URL + "/missing"
+	err := backend.Check()
+	assert.Equal(t, CheckUnexpectedStatus, checkReason(err))
+	assert.Equal(t, err.Error(), backend.Health().LastError)
+
+	backend.CheckConfig.ExpectStatus = []int{http.StatusNotFound}
+	assert.NoError(t, backend.Check())
+	assert.Empty(t, backend.Health().LastError)
+
+	// The body is fetched with GET and matched
+	backend.CheckConfig = BackendCheckConfig{
+		CheckURL:        target.URL + "/status",
+		Headers:         map[string]string{"X-Check": "socks5lb"},
+		ExpectBody:      `"status":"ok"`,
+		ExpectBodyRegex: `"version":[0-9]+`,
+		Timeout:         2,
+	}
+	assert.NoError(t, backend.Check())
+
+	backend.CheckConfig.ExpectBody = `"status":"degraded"`
+	assert.Equal(t, CheckBodyMismatch, checkReason(backend.Check()))
+
+	backend.CheckConfig.ExpectBody, backend.CheckConfig.ExpectBodyRegex = "", `"version":[a-z]+`
+	assert.Equal(t, CheckBodyMismatch, checkReason(backend.Check()))
+
+	// Several URLs pass with all or any of them
+	backend.CheckConfig = BackendCheckConfig{
+		CheckURLs: []string{target.URL + "/", target.URL + "/missing"},
+		Timeout:   2,
+	}
+	assert.Equal(t, CheckUnexpectedStatus, checkReason(backend.Check()))
+
+	backend.CheckConfig.Require = CheckRequireAny
+	assert.NoError(t, backend.Check())
+
+	backend.CheckConfig.CheckURLs = []string{target.URL + "/missing", target.URL + "/missing"}
+	assert.Error(t, backend.Check())
+}
+
+func TestBackend_HTTPHealthCheckTLS(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(target.Close)
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{CheckURL: target.URL, Timeout: 2})
+	assert.Error(t, backend.Check())
+
+	backend.CheckConfig.TLS.InsecureSkipVerify = true
+	assert.NoError(t, backend.Check())
+
+	// The certificate of the test server is trusted through the CA file
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: target.Certificate().Raw,
+	}), 0o600))
+
+	backend.CheckConfig.TLS = CheckTLSConfig{CAFile: caFile}
+	assert.NoError(t, backend.Check())
+
+	backend.CheckConfig.TLS.ServerName = "socks5lb.invalid"
+	assert.Error(t, backend.Check())
+}
+
+func TestBackend_TCPHealthCheck(t *testing.T) {
+	// A target greeting like an SMTP server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("220 mx.example.com ESMTP ready\r\n"))
+			_ = conn.Close()
+		}
+	}()
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{
+		Type:        CheckTypeTCP,
+		CheckTarget: l.Addr().String(),
+		Expect:      "220 ",
+		ExpectRegex: `ESMTP`,
+		Timeout:     1,
+	})
+	assert.NoError(t, backend.Check())
+
+	backend.CheckConfig.Expect = "554 "
+	assert.Equal(t, CheckResponseMismatch, checkReason(backend.Check()))
+
+	backend.CheckConfig.Expect, backend.CheckConfig.ExpectRegex = "", `LMTP`
+	assert.Equal(t, CheckResponseMismatch, checkReason(backend.Check()))
+
+	// The payload is sent before reading the response
+	backend.CheckConfig = BackendCheckConfig{
+		Type:        CheckTypeTCP,
+		CheckTarget: startEchoServer(t),
+		Send:        "PING :socks5lb\r\n",
+		Expect:      "PING",
+		Timeout:     2,
+	}
+	assert.NoError(t, backend.Check())
+
+	// Without expectations the connection is enough
+	backend.CheckConfig.Send, backend.CheckConfig.Expect = "", ""
+	assert.NoError(t, backend.Check())
+
+	backend.CheckConfig.CheckTarget = freeAddr(t)
+	assert.Equal(t, CheckConnectRefused, checkReason(backend.Check()))
+
+	backend.CheckConfig.CheckTarget = ""
+	assert.Error(t, backend.Check())
+}
+
+// startDNSServer starts a resolver answering every A query for example.com with the address
+// and every other query with NXDOMAIN
+func startDNSServer(t *testing.T, addr string) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxUDPPacketSize)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+
+			answer := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+				Questions: query.Questions,
+			}
+			if question := query.Questions[0]; question.Name.String() == "example.com." {
+				var a [4]byte
+				copy(a[:], net.ParseIP(addr).To4())
+				answer.RCode = dnsmessage.RCodeSuccess
+				answer.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: a},
+				}}
+			}
+
+			data, err := answer.Pack()
+			if err == nil {
+				_, _ = conn.WriteToUDP(data, client)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestBackend_UDPDNSHealthCheck(t *testing.T) {
+	resolver := startDNSServer(t, "93.184.215.14")
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{
+		Type:    CheckTypeUDPDNS,
+		DNS:     &DNSCheckConfig{Resolver: resolver, ExpectAnswer: "93.184.215.14"},
+		Timeout: 1,
+	})
+	assert.NoError(t, backend.Check())
+	assert.True(t, backend.Alive())
+	assert.True(t, backend.UDPCapable())
+
+	backend.CheckConfig.DNS.ExpectAnswer = "192.0.2.1"
+	assert.Equal(t, CheckResponseMismatch, checkReason(backend.Check()))
+
+	backend.CheckConfig.DNS = &DNSCheckConfig{Resolver: resolver, Name: "missing.example.com"}
+	assert.Equal(t, CheckResponseMismatch, checkReason(backend.Check()))
+
+	// A resolver which never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = silent.Close() })
+
+	backend.CheckConfig.DNS = &DNSCheckConfig{Resolver: silent.LocalAddr().String()}
+	assert.Equal(t, CheckNoAnswer, checkReason(backend.Check()))
+}
+
+func TestBackend_UDPCapable(t *testing.T) {
+	addr := startSocks5Backend(t, "", "")
+
+	// Without a udp_dns check backends are assumed to relay UDP
+	tcpOnly := NewBackend(addr, BackendCheckConfig{Type: CheckTypeSocks5, Timeout: 1})
+	assert.NoError(t, tcpOnly.Check())
+	assert.Nil(t, tcpOnly.UDP())
+	assert.True(t, tcpOnly.UDPCapable())
+
+	// A broken UDP relay leaves the backend in rotation for TCP only
+	tcpOnly.CheckConfig.DNS = &DNSCheckConfig{Resolver: freeAddr(t)}
+	assert.NoError(t, tcpOnly.Check())
+	assert.True(t, tcpOnly.Alive())
+	assert.False(t, tcpOnly.UDPCapable())
+	assert.NotEmpty(t, tcpOnly.UDP().LastError)
+
+	udp := NewBackend(addr+"#udp", BackendCheckConfig{InitialAlive: true})
+	pool := newTestPool(tcpOnly, udp)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, udp, pool.Pick(WithUDP(context.Background()), nil))
+	}
+
+	data, err := json.Marshal(tcpOnly)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"udp":{"healthy":false`)
+}
@@ -3,7 +3,7 @@
  * Author: Ming Cheng<mingcheng@outlook.com>
  *
  * Created Date: Wednesday, July 6th 2022, 2:14:35 pm
- * Last Modified: Thursday, July 7th 2022, 6:29:55 pm
+ * Last Modified: 2026-10-18 10:03:43
  *
  * http://www.opensource.org/licenses/MIT
  */
@@ -29,13 +29,29 @@ func (p *program) Init(svc.Environment) (err error) {
 	log.Tracef("new initial backend pools")
 	pool := socks5lb.NewPool()
 
-	for _, v := range p.Config.Backends {
+	log.Tracef("declare %d backend groups", len(p.Config.Groups))
+	if err = pool.SetGroups(p.Config.Groups); err != nil {
+		return
+	}
+
+	for i := range p.Config.Backends {
+		v := &p.Config.Backends[i]
 		log.Tracef("add backend %s", v.Addr)
 		backend := socks5lb.NewBackend(v.Addr, v.CheckConfig)
-		_ = pool.Add(backend)
+		backend.UserName, backend.Password = v.UserName, v.Password
+		backend.Weight, backend.Group = v.Weight, v.Group
+		if err := pool.Add(backend); err != nil {
+			log.Error(err)
+		}
 	}
 
 	p.Server, err = socks5lb.NewServer(pool, p.Config.ServerConfig)
+	if err != nil {
+		return
+	}
+
+	log.Tracef("load %d configured users, users file %q", len(p.Config.Users), p.Config.UsersFile)
+	p.Server.Users, err = socks5lb.NewUserStore(p.Config.Users, p.Config.UsersFile)
 
 	return
 }
@@ -9,7 +9,7 @@
  * File Created: Tuesday, June 21st 2022, 6:03:38 pm
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:21:34
+ * Last Modified: 2026-10-18 10:26:59
  */
 
 package socks5lb
@@ -28,12 +28,63 @@ type ServerConfig struct {
 
 	// Sock5 SOCKS5 proxy configuration
 	Sock5 struct {
-		Addr string `yaml:"addr"`
+		Addr           string `yaml:"addr"`
+		Strategy       string `yaml:"strategy"`
+		UDPIdleTimeout uint   `yaml:"udp_idle_timeout"` // seconds before an idle UDP association expires, default 60
 	} `yaml:"socks5"`
+
+	// Socks4 SOCKS4 and SOCKS4a proxy configuration for legacy clients
+	Socks4 struct {
+		Addr     string `yaml:"addr"`
+		Strategy string `yaml:"strategy"`
+	} `yaml:"socks4"`
+
+	// HTTPProxy HTTP proxy configuration, serves CONNECT and absolute-URI requests
+	HTTPProxy struct {
+		Addr     string `yaml:"addr"`
+		Strategy string `yaml:"strategy"`
+	} `yaml:"http_proxy"`
+
+	// Mixed serves SOCKS5, SOCKS4/4a and HTTP proxy clients on a single port
+	Mixed struct {
+		Addr     string `yaml:"addr"`
+		Strategy string `yaml:"strategy"`
+	} `yaml:"mixed"`
+
+	// Sessions pins the session ids carried in the usernames of authenticated clients to a backend
+	Sessions struct {
+		Pattern string `yaml:"pattern"` // regular expression matching the session part of the username, empty disables
+		TTL     uint   `yaml:"ttl"`     // seconds a session stays pinned, default 600
+	} `yaml:"sessions"`
+
+	// Rules routes targets to backend groups, DIRECT or REJECT
+	Rules struct {
+		File string `yaml:"file"` // YAML file with the routing rules, reloadable through the admin API
+	} `yaml:"rules"`
+
+	// HealthCheck schedules the periodic health checks of the backends
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+
+	// ExitIP discovers the public IP each backend egresses from and locates it
+	ExitIP ExitIPConfig `yaml:"exit_ip"`
+
+	// PassiveHealth ejects backends failing the connections of clients
+	PassiveHealth PassiveHealthConfig `yaml:"passive_health"`
+
+	// Upstream controls how connections are opened through the backends
+	Upstream struct {
+		MaxAttempts uint `yaml:"max_attempts"` // backends tried before giving up, default 3
+		Timeout     uint `yaml:"timeout"`      // per-attempt timeout in seconds, default 10
+	} `yaml:"upstream"`
 }
 
 // Configure represents the complete application configuration
 type Configure struct {
 	ServerConfig ServerConfig `yaml:"server"`
 	Backends     []Backend    `yaml:"backends"`
+	Groups       []Group      `yaml:"groups"` // priority tiers of the backend groups
+
+	// Users required to authenticate on the frontend listeners, none means open access
+	Users     []User `yaml:"users"`
+	UsersFile string `yaml:"users_file"` // htpasswd-style file with bcrypt hashes
 }
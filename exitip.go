@@ -0,0 +1,305 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: exitip.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:26:59
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:26:59
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultExitIPInterval is how long a discovered exit IP is trusted before it is fetched again
+	DefaultExitIPInterval = 10 * time.Minute
+	// maxExitIPResponseSize is the number of bytes of the echo URL response parsed for the IP
+	maxExitIPResponseSize = 4096
+)
+
+// ExitIPConfig controls the discovery of the public IP the backends egress from
+type ExitIPConfig struct {
+	URL       string `yaml:"url"`        // echo URL answering with the IP of the caller as text or JSON, empty disables
+	Interval  uint   `yaml:"interval"`   // seconds between two discoveries of a backend, default 600
+	CountryDB string `yaml:"country_db"` // MaxMind-format mmdb with countries like GeoLite2-Country.mmdb, optional
+	ASNDB     string `yaml:"asn_db"`     // MaxMind-format mmdb with autonomous systems like GeoLite2-ASN.mmdb, optional
+}
+
+// ExitInfo describes the public IP a backend egresses from
+type ExitInfo struct {
+	IP         string    `json:"ip"`
+	Country    string    `json:"country,omitempty"` // ISO 3166-1 code
+	ASN        uint      `json:"asn,omitempty"`
+	ASOrg      string    `json:"as_org,omitempty"`
+	Since      time.Time `json:"since"` // when the backend was first seen egressing from the IP
+	CheckedAt  time.Time `json:"checked_at"`
+	Changes    uint      `json:"changes"`            // times the exit IP changed
+	PreviousIP string    `json:"previous,omitempty"` // exit IP before the latest change
+}
+
+// exitState holds the latest exit IP discovered for a backend
+type exitState struct {
+	info      *ExitInfo
+	attempted time.Time // start of the latest discovery, successful or not
+	lock      sync.Mutex
+}
+
+// Exit returns the exit IP discovered for the backend, nil if there is none yet
+func (b *Backend) Exit() *ExitInfo {
+	b.exit.lock.Lock()
+	defer b.exit.lock.Unlock()
+
+	if b.exit.info == nil {
+		return nil
+	}
+
+	info := *b.exit.info
+	return &info
+}
+
+// attemptExit records the start of a discovery of the exit IP
+func (b *Backend) attemptExit(now time.Time) {
+	b.exit.lock.Lock()
+	defer b.exit.lock.Unlock()
+	b.exit.attempted = now
+}
+
+// lastExitAttempt returns the start of the latest discovery of the exit IP, zero if there was none
+func (b *Backend) lastExitAttempt() time.Time {
+	b.exit.lock.Lock()
+	defer b.exit.lock.Unlock()
+	return b.exit.attempted
+}
+
+// setExit records a discovered exit IP, returns whether it differs from the previous one
+func (b *Backend) setExit(info ExitInfo) (changed bool) {
+	b.exit.lock.Lock()
+	defer b.exit.lock.Unlock()
+
+	info.Since = info.CheckedAt
+	if previous := b.exit.info; previous != nil {
+		info.Changes, info.PreviousIP = previous.Changes, previous.PreviousIP
+		if previous.IP == info.IP {
+			info.Since = previous.Since
+		} else {
+			log.Warnf("exit IP of backend %s changed from %s to %s", b.Addr, previous.IP, info.IP)
+			info.Changes, info.PreviousIP, changed = info.Changes+1, previous.IP, true
+		}
+	}
+
+	b.exit.info = &info
+	return
+}
+
+// ExitFilter restricts backends by their exit IP, routing rules attach it to connections
+type ExitFilter struct {
+	Countries []string `json:"exit_country,omitempty"`
+	ASNs      []uint   `json:"exit_asn,omitempty"`
+}
+
+// Empty reports whether the filter accepts every backend
+func (f ExitFilter) Empty() bool {
+	return len(f.Countries) == 0 && len(f.ASNs) == 0
+}
+
+// Match reports whether the exit satisfies the filter, an unknown exit only matches an empty filter
+func (f ExitFilter) Match(exit *ExitInfo) bool {
+	if f.Empty() {
+		return true
+	}
+	if exit == nil {
+		return false
+	}
+
+	countryOK := len(f.Countries) == 0 || slices.ContainsFunc(f.Countries, func(country string) bool {
+		return strings.EqualFold(country, exit.Country)
+	})
+	return countryOK && (len(f.ASNs) == 0 || slices.Contains(f.ASNs, exit.ASN))
+}
+
+type exitKey struct{}
+
+// WithExit returns a context restricting the backends to the ones matching the exit filter
+func WithExit(ctx context.Context, filter ExitFilter) context.Context {
+	return context.WithValue(ctx, exitKey{}, filter)
+}
+
+// ExitFrom returns the exit filter of the context, empty means all backends
+func ExitFrom(ctx context.Context) ExitFilter {
+	filter, _ := ctx.Value(exitKey{}).(ExitFilter)
+	return filter
+}
+
+// ExitIPDiscovery fetches the echo URL through the backends and locates their exit IP
+type ExitIPDiscovery struct {
+	url      string
+	interval time.Duration
+	country  *maxminddb.Reader
+	asn      *maxminddb.Reader
+	lock     sync.RWMutex // guards the databases against Close during lookups
+}
+
+// due reports whether the exit IP of the backend should be discovered, failed discoveries
+// are retried after the interval as well so that a broken echo URL is not fetched with every
+// health check, it is nil-safe
+func (d *ExitIPDiscovery) due(backend *Backend, changed bool) bool {
+	if d == nil || !backend.Alive() {
+		return false
+	}
+
+	return changed || time.Since(backend.lastExitAttempt()) >= d.interval
+}
+
+// parseExitIP accepts a bare IP or a JSON object with an "ip" field as answered by echo services
+func parseExitIP(body []byte) (net.IP, error) {
+	text := strings.TrimSpace(string(body))
+
+	var object struct {
+		IP string `json:"ip"`
+	}
+	if strings.HasPrefix(text, "{") && json.Unmarshal([]byte(text), &object) == nil {
+		text = object.IP
+	}
+
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil, fmt.Errorf("no IP address in the response %q", text)
+	}
+
+	return ip, nil
+}
+
+// locate adds the country and the autonomous system of the IP from the databases
+func (d *ExitIPDiscovery) locate(info *ExitInfo, ip net.IP) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if d.country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := d.country.Lookup(ip, &record); err != nil {
+			log.Warnf("failed to look up the country of %s: %v", ip, err)
+		}
+		info.Country = record.Country.ISOCode
+	}
+
+	if d.asn != nil {
+		var record struct {
+			ASN   uint   `maxminddb:"autonomous_system_number"`
+			ASOrg string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := d.asn.Lookup(ip, &record); err != nil {
+			log.Warnf("failed to look up the autonomous system of %s: %v", ip, err)
+		}
+		info.ASN, info.ASOrg = record.ASN, record.ASOrg
+	}
+}
+
+// Discover fetches the echo URL through the backend and records its exit IP
+func (d *ExitIPDiscovery) Discover(backend *Backend) (err error) {
+	backend.attemptExit(time.Now())
+
+	// The TLS settings of the health check are meant for its URL, not for the echo URL
+	resp, err := backend.socks5HTTPClient(nil).Get(d.url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("echo URL answered with status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxExitIPResponseSize))
+	if err != nil {
+		return
+	}
+
+	ip, err := parseExitIP(body)
+	if err != nil {
+		return
+	}
+
+	info := ExitInfo{IP: ip.String(), CheckedAt: time.Now()}
+	d.locate(&info, ip)
+	backend.setExit(info)
+
+	log.Debugf("backend %s egresses from %s (%s, AS%d)", backend.Addr, info.IP, info.Country, info.ASN)
+	return
+}
+
+// Close releases the databases, backends are no longer located afterwards, it is nil-safe
+func (d *ExitIPDiscovery) Close() (err error) {
+	if d == nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.country != nil {
+		err = d.country.Close()
+		d.country = nil
+	}
+
+	if d.asn != nil {
+		err = errors.Join(err, d.asn.Close())
+		d.asn = nil
+	}
+
+	return
+}
+
+// NewExitIPDiscovery opens the databases of the configuration, it returns nil if no echo URL is set
+func NewExitIPDiscovery(config ExitIPConfig) (discovery *ExitIPDiscovery, err error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+
+	discovery = &ExitIPDiscovery{
+		url:      config.URL,
+		interval: time.Duration(config.Interval) * time.Second,
+	}
+	if discovery.interval == 0 {
+		discovery.interval = DefaultExitIPInterval
+	}
+
+	if config.CountryDB != "" {
+		if discovery.country, err = maxminddb.Open(config.CountryDB); err != nil {
+			return nil, fmt.Errorf("failed to open country database: %w", err)
+		}
+	}
+
+	if config.ASNDB != "" {
+		if discovery.asn, err = maxminddb.Open(config.ASNDB); err != nil {
+			_ = discovery.Close()
+			return nil, fmt.Errorf("failed to open ASN database: %w", err)
+		}
+	}
+
+	return
+}
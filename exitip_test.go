@@ -0,0 +1,256 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: exitip_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:26:59
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:26:59
+ */
+
+package socks5lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeMMDB encodes strings, unsigned integers and maps in the MaxMind DB data format
+func encodeMMDB(buf *bytes.Buffer, value any) {
+	// Sizes from 29 on take another byte, which follows the extended type if there is one
+	control := func(kind byte, size int) {
+		head, extra := byte(size), []byte(nil)
+		if size >= 29 {
+			head, extra = 29, []byte{byte(size - 29)}
+		}
+
+		if kind <= 7 {
+			buf.WriteByte(kind<<5 | head)
+		} else {
+			buf.WriteByte(head)
+			buf.WriteByte(kind - 7)
+		}
+		buf.Write(extra)
+	}
+
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint:
+		var data [8]byte
+		binary.BigEndian.PutUint64(data[:], uint64(v))
+		trimmed := bytes.TrimLeft(data[:], "\x00")
+		control(9, len(trimmed))
+		buf.Write(trimmed)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		control(7, len(keys))
+		for _, key := range keys {
+			encodeMMDB(buf, key)
+			encodeMMDB(buf, v[key])
+		}
+	default:
+		panic(fmt.Sprintf("unsupported value %T", value))
+	}
+}
+
+// writeMMDB writes an IPv4 MaxMind DB holding the record for a single address
+func writeMMDB(t *testing.T, ip string, record map[string]any) string {
+	addr := binary.BigEndian.Uint32(net.ParseIP(ip).To4())
+	const nodeCount = 32
+
+	// One node per bit leads to the record, every other branch to no data
+	var buf bytes.Buffer
+	for i := 0; i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = nodeCount + 16
+		}
+
+		records := [2]uint32{nodeCount, nodeCount}
+		records[addr>>(31-i)&1] = next
+		for _, r := range records {
+			buf.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+
+	buf.Write(make([]byte, 16))
+	encodeMMDB(&buf, record)
+
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(&buf, map[string]any{
+		"binary_format_major_version": uint(2),
+		"binary_format_minor_version": uint(0),
+		"build_epoch":                 uint(0),
+		"database_type":               "socks5lb-test",
+		"ip_version":                  uint(4),
+		"node_count":                  uint(nodeCount),
+		"record_size":                 uint(24),
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+	return path
+}
+
+func TestParseExitIP(t *testing.T) {
+	for body, expected := range map[string]string{
+		"203.0.113.7\n":                       "203.0.113.7",
+		`{"ip":"2001:db8::1","country":"DE"}`: "2001:db8::1",
+	} {
+		ip, err := parseExitIP([]byte(body))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ip.String())
+	}
+
+	_, err := parseExitIP([]byte("<html>not an ip</html>"))
+	assert.Error(t, err)
+}
+
+func TestExitIPDiscovery_Discover(t *testing.T) {
+	var exitIP atomic.Value
+	exitIP.Store("203.0.113.7")
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"ip":%q}`, exitIP.Load())
+	}))
+	t.Cleanup(echo.Close)
+
+	discovery, err := NewExitIPDiscovery(ExitIPConfig{
+		URL:       echo.URL,
+		CountryDB: writeMMDB(t, "203.0.113.7", map[string]any{"country": map[string]any{"iso_code": "JP"}}),
+		ASNDB: writeMMDB(t, "203.0.113.7", map[string]any{
+			"autonomous_system_number":       uint(64500),
+			"autonomous_system_organization": "Example Networks",
+		}),
+	})
+	assert.NoError(t, err)
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true, Timeout: 2})
+	assert.True(t, discovery.due(backend, false))
+	assert.NoError(t, discovery.Discover(backend))
+	assert.False(t, discovery.due(backend, false))
+
+	exit := backend.Exit()
+	assert.Equal(t, "203.0.113.7", exit.IP)
+	assert.Equal(t, "JP", exit.Country)
+	assert.Equal(t, uint(64500), exit.ASN)
+	assert.Equal(t, "Example Networks", exit.ASOrg)
+	assert.Zero(t, exit.Changes)
+
+	// A new exit IP is detected and not found in the databases
+	exitIP.Store("198.51.100.1")
+	assert.NoError(t, discovery.Discover(backend))
+	exit = backend.Exit()
+	assert.Equal(t, "198.51.100.1", exit.IP)
+	assert.Equal(t, "203.0.113.7", exit.PreviousIP)
+	assert.Equal(t, uint(1), exit.Changes)
+	assert.Empty(t, exit.Country)
+	assert.Zero(t, exit.ASN)
+
+	data, err := json.Marshal(backend)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"exit":{"ip":"198.51.100.1"`)
+
+	// The TLS settings of the health check do not apply to the echo URL
+	private := NewBackend(backend.Addr, BackendCheckConfig{InitialAlive: true, Timeout: 2})
+	private.CheckConfig.TLS.CAFile = filepath.Join(t.TempDir(), "missing-ca.pem")
+	assert.NoError(t, discovery.Discover(private))
+	assert.Equal(t, "198.51.100.1", private.Exit().IP)
+
+	// Failed discoveries wait for the interval as well
+	unreachable := NewBackend(freeAddr(t), BackendCheckConfig{InitialAlive: true, Timeout: 2})
+	assert.Error(t, discovery.Discover(unreachable))
+	assert.False(t, discovery.due(unreachable, false))
+	assert.True(t, discovery.due(unreachable, true))
+	assert.Nil(t, unreachable.Exit())
+
+	// Backends are no longer located once the databases are closed
+	assert.NoError(t, discovery.Close())
+	exitIP.Store("203.0.113.7")
+	assert.NoError(t, discovery.Discover(backend))
+	assert.Equal(t, "203.0.113.7", backend.Exit().IP)
+	assert.Empty(t, backend.Exit().Country)
+
+	// Discovery is disabled without an echo URL
+	disabled, err := NewExitIPDiscovery(ExitIPConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, disabled)
+	assert.False(t, disabled.due(backend, true))
+
+	_, err = NewExitIPDiscovery(ExitIPConfig{URL: echo.URL, CountryDB: filepath.Join(t.TempDir(), "missing.mmdb")})
+	assert.Error(t, err)
+
+	_, err = NewExitIPDiscovery(ExitIPConfig{
+		URL:       echo.URL,
+		CountryDB: writeMMDB(t, "203.0.113.7", map[string]any{"country": map[string]any{"iso_code": "JP"}}),
+		ASNDB:     filepath.Join(t.TempDir(), "missing.mmdb"),
+	})
+	assert.Error(t, err)
+}
+
+func TestPool_PickExit(t *testing.T) {
+	jp := NewBackend("10.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	jp.setExit(ExitInfo{IP: "203.0.113.7", Country: "JP", ASN: 64500})
+	us := NewBackend("10.0.0.2:1080", BackendCheckConfig{InitialAlive: true})
+	us.setExit(ExitInfo{IP: "198.51.100.1", Country: "US", ASN: 64501})
+	unknown := NewBackend("10.0.0.3:1080", BackendCheckConfig{InitialAlive: true})
+
+	pool := newTestPool(jp, us, unknown)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, jp, pool.Pick(WithExit(context.Background(), ExitFilter{Countries: []string{"jp"}}), nil))
+		assert.Equal(t, us, pool.Pick(WithExit(context.Background(), ExitFilter{ASNs: []uint{64501}}), nil))
+	}
+	assert.Nil(t, pool.Pick(WithExit(context.Background(), ExitFilter{Countries: []string{"JP"}, ASNs: []uint{64501}}), nil))
+}
+
+func TestRouter_ExitRules(t *testing.T) {
+	path := writeRules(t, `
+rules:
+  - name: streaming
+    domain_suffix: [example.tv]
+    exit_country: [JP]
+`)
+
+	router, err := NewRouter(path)
+	assert.NoError(t, err)
+
+	route := router.Match("www.example.tv:443")
+	assert.Equal(t, 0, route.Index)
+	assert.Empty(t, route.Outbound)
+	assert.Equal(t, []string{"JP"}, route.Countries)
+
+	data, err := json.Marshal(route)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"exit_country":["JP"]`)
+
+	_, err = NewRouter(writeRules(t, `
+rules:
+  - domain: [example.com]
+    exit_asn: [64500]
+    outbound: DIRECT
+`))
+	assert.Error(t, err)
+}
@@ -6,10 +6,12 @@ require (
 	github.com/LiamHaworth/go-tproxy v0.0.0-20190726054950-ef7efd7f24ed
 	github.com/gin-gonic/gin v1.9.1
 	github.com/judwhite/go-svc v1.2.1
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/rocksolidlabs/gin-logrus v0.0.0-20180520211829-e80b1f0c4a0c
 	github.com/sirupsen/logrus v1.8.1
-	github.com/stretchr/testify v1.8.3
+	github.com/stretchr/testify v1.9.0
 	github.com/txthinking/socks5 v0.0.0-20220615051428-39268faee3e6
+	golang.org/x/crypto v0.31.0
 	golang.org/x/net v0.21.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -38,7 +40,6 @@ require (
 	github.com/txthinking/x v0.0.0-20210326105829-476fab902fbe // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
@@ -0,0 +1,156 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: group.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:02:27
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:02:27
+ */
+
+package socks5lb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultGroupPriority is the priority of backends without a group or with an undeclared one
+const DefaultGroupPriority = 0
+
+// Group ranks the backends sharing its name, the pool only draws from a group with a higher
+// priority value when all groups with lower values have no healthy backend left
+type Group struct {
+	Name     string `yaml:"name" json:"name"`
+	Priority int    `yaml:"priority" json:"priority"`
+	Strategy string `yaml:"strategy" json:"strategy,omitempty"` // balancer of connections routed to the group, empty keeps the listener's
+}
+
+// GroupStatus describes a group of the pool and its backends
+type GroupStatus struct {
+	Group
+	Backends int  `json:"backends"`
+	Healthy  int  `json:"healthy"`
+	Active   bool `json:"active"` // whether new connections are drawn from this group
+}
+
+// SetGroups replaces the declared groups of the pool
+func (b *Pool) SetGroups(groups []Group) (err error) {
+	declared := make(map[string]Group, len(groups))
+	balancers := make(map[string]Balancer)
+	for _, group := range groups {
+		if group.Name == "" {
+			return fmt.Errorf("group with empty name is not allowed")
+		}
+		if _, ok := declared[group.Name]; ok {
+			return fmt.Errorf("group %s is declared more than once", group.Name)
+		}
+		declared[group.Name] = group
+
+		if group.Strategy != "" {
+			if balancers[group.Name], err = NewBalancer(group.Strategy); err != nil {
+				return fmt.Errorf("group %s: %w", group.Name, err)
+			}
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.groups, b.balancers = declared, balancers
+	return
+}
+
+// GroupBalancer returns the balancer of the group's strategy, nil if it has none
+func (b *Pool) GroupBalancer(name string) Balancer {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.balancers[name]
+}
+
+// priority returns the priority of the backend by its group, the caller must hold the lock
+func (b *Pool) priority(backend *Backend) int {
+	if group, ok := b.groups[backend.Group]; ok {
+		return group.Priority
+	}
+	return DefaultGroupPriority
+}
+
+// preferredTier keeps the candidates sharing the lowest priority value
+func (b *Pool) preferredTier(candidates []*Backend) []*Backend {
+	if len(candidates) <= 1 {
+		return candidates
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if len(b.groups) == 0 {
+		return candidates
+	}
+
+	best := b.priority(candidates[0])
+	for _, candidate := range candidates[1:] {
+		best = min(best, b.priority(candidate))
+	}
+
+	tier := candidates[:0]
+	for _, candidate := range candidates {
+		if b.priority(candidate) == best {
+			tier = append(tier, candidate)
+		}
+	}
+
+	return tier
+}
+
+// Groups returns the status of every group having backends or being declared,
+// ordered by priority and name
+func (b *Pool) Groups() (groups []GroupStatus) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	byName := make(map[string]*GroupStatus)
+	for name, group := range b.groups {
+		byName[name] = &GroupStatus{Group: group}
+	}
+
+	for _, backend := range b.backends {
+		status, ok := byName[backend.Group]
+		if !ok {
+			status = &GroupStatus{Group: Group{Name: backend.Group, Priority: b.priority(backend)}}
+			byName[backend.Group] = status
+		}
+
+		status.Backends++
+		if backend.Alive() {
+			status.Healthy++
+		}
+	}
+
+	// The first tier with a healthy backend is the active one
+	active, found := 0, false
+	for _, status := range byName {
+		if status.Healthy > 0 && (!found || status.Priority < active) {
+			active, found = status.Priority, true
+		}
+	}
+
+	groups = make([]GroupStatus, 0, len(byName))
+	for _, status := range byName {
+		status.Active = found && status.Healthy > 0 && status.Priority == active
+		groups = append(groups, *status)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Priority != groups[j].Priority {
+			return groups[i].Priority < groups[j].Priority
+		}
+		return groups[i].Name < groups[j].Name
+	})
+
+	return
+}
@@ -0,0 +1,94 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: group_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:02:27
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:02:27
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool_GroupTiers(t *testing.T) {
+	backends := newTestBackends(1, 1, 1, 1)
+	backends[0].Group, backends[1].Group = "primary", "primary"
+	backends[2].Group, backends[3].Group = "emergency", "emergency"
+
+	pool := newTestPool(backends...)
+	assert.NoError(t, pool.SetGroups([]Group{
+		{Name: "primary", Priority: 0},
+		{Name: "emergency", Priority: 10},
+	}))
+
+	picks := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 20; i++ {
+			counts[pool.Next().Group]++
+		}
+		return counts
+	}
+
+	assert.Equal(t, map[string]int{"primary": 20}, picks())
+
+	// One healthy primary backend keeps the emergency tier unused
+	backends[0].SetAlive(false)
+	assert.Equal(t, map[string]int{"primary": 20}, picks())
+
+	backends[1].SetAlive(false)
+	assert.Equal(t, map[string]int{"emergency": 20}, picks())
+
+	groups := pool.Groups()
+	assert.Len(t, groups, 2)
+	assert.Equal(t, "primary", groups[0].Name)
+	assert.False(t, groups[0].Active)
+	assert.Equal(t, 2, groups[1].Healthy)
+	assert.True(t, groups[1].Active)
+
+	// The preferred tier takes over again once it recovers
+	backends[1].SetAlive(true)
+	assert.Equal(t, map[string]int{"primary": 20}, picks())
+
+	// Failing over tries the lower tier after the preferred one is exhausted
+	assert.Equal(t, backends[2].Group, pool.NextExclude(backends[1]).Group)
+
+	// Routing to a group ignores the tiers
+	assert.Equal(t, "emergency", pool.Pick(WithGroup(context.Background(), "emergency"), nil).Group)
+}
+
+func TestPool_SetGroups(t *testing.T) {
+	pool := newTestPool()
+	assert.Error(t, pool.SetGroups([]Group{{Name: ""}}))
+	assert.Error(t, pool.SetGroups([]Group{{Name: "a"}, {Name: "a", Priority: 1}}))
+	assert.Error(t, pool.SetGroups([]Group{{Name: "a", Strategy: "unknown"}}))
+	assert.NoError(t, pool.SetGroups(nil))
+	assert.Empty(t, pool.Groups())
+
+	// Undeclared groups share the default priority
+	backends := newTestBackends(1, 1)
+	backends[1].Group = "other"
+	assert.NoError(t, pool.Add(backends[0]))
+	assert.NoError(t, pool.Add(backends[1]))
+	assert.NoError(t, pool.SetGroups([]Group{{Name: "backup", Priority: 1, Strategy: StrategyLeastConnections}}))
+	assert.IsType(t, &LeastConnectionsBalancer{}, pool.GroupBalancer("backup"))
+	assert.Nil(t, pool.GroupBalancer("other"))
+
+	groups := pool.Groups()
+	assert.Len(t, groups, 3)
+	assert.Equal(t, "", groups[0].Name)
+	assert.Equal(t, "other", groups[1].Name)
+	assert.True(t, groups[0].Active && groups[1].Active)
+	assert.Equal(t, "backup", groups[2].Name)
+	assert.False(t, groups[2].Active)
+}
@@ -0,0 +1,257 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: health.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:15:55
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:24:01
+ */
+
+package socks5lb
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRise is the number of passing checks in a row bringing a backend back
+	DefaultRise = 2
+	// DefaultFall is the number of failing checks in a row taking a backend down
+	DefaultFall = 3
+	// DefaultFlapThreshold is the number of state changes within the flap window damping a backend
+	DefaultFlapThreshold = 4
+	// DefaultFlapWindow is the period the state changes of a backend are counted over
+	DefaultFlapWindow = 10 * time.Minute
+	// DefaultFlapPenalty is how long a flapping backend is kept down after it recovered
+	DefaultFlapPenalty = 5 * time.Minute
+	// HealthHistorySize is the number of state changes kept per backend
+	HealthHistorySize = 32
+)
+
+// HealthEvent is a state change of a backend decided by its health checks
+type HealthEvent struct {
+	Time   time.Time `json:"time"`
+	Alive  bool      `json:"alive"`
+	Reason string    `json:"reason,omitempty"` // error of the check taking the backend down
+}
+
+// HealthStatus is a snapshot of the health check state of a backend
+type HealthStatus struct {
+	Healthy     bool          `json:"healthy"`
+	Successes   uint          `json:"successes"` // passing checks in a row
+	Failures    uint          `json:"failures"`  // failing checks in a row
+	LastCheck   *time.Time    `json:"last_check,omitempty"`
+	LastError   string        `json:"last_error,omitempty"` // failure reason of the latest check
+	DampedUntil *time.Time    `json:"damped_until,omitempty"`
+	History     []HealthEvent `json:"history"` // state changes, oldest first
+}
+
+// healthState turns the results of single health checks into state changes of a backend,
+// a backend goes down after fall failures and comes back after rise passes unless it is damped
+type healthState struct {
+	checked     bool // the first check decides the state on its own
+	healthy     bool
+	successes   uint
+	failures    uint
+	dampedUntil time.Time
+	lastCheck   time.Time
+	lastError   string
+	history     []HealthEvent
+	truncated   bool // the first recorded change got dropped from the history
+
+	lock sync.Mutex
+}
+
+// change records a state change, the caller must hold the lock
+func (h *healthState) change(now time.Time, healthy bool, err error) {
+	h.healthy = healthy
+
+	event := HealthEvent{Time: now, Alive: healthy}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+
+	if len(h.history) >= HealthHistorySize {
+		h.history, h.truncated = append(h.history[:0], h.history[1:]...), true
+	}
+	h.history = append(h.history, event)
+}
+
+// flaps counts the state changes since the given time, the initial state is not a change,
+// the caller must hold the lock
+func (h *healthState) flaps(since time.Time) (count int) {
+	for i, event := range h.history {
+		if (i > 0 || h.truncated) && event.Time.After(since) {
+			count++
+		}
+	}
+	return
+}
+
+// rise returns the number of passing checks bringing a backend back
+func (c BackendCheckConfig) rise() uint {
+	if c.Rise == 0 {
+		return DefaultRise
+	}
+	return c.Rise
+}
+
+// fall returns the number of failing checks taking a backend down
+func (c BackendCheckConfig) fall() uint {
+	if c.Fall == 0 {
+		return DefaultFall
+	}
+	return c.Fall
+}
+
+// flapThreshold returns the number of state changes within the flap window damping a backend
+func (c BackendCheckConfig) flapThreshold() int {
+	if c.FlapThreshold == 0 {
+		return DefaultFlapThreshold
+	}
+	return int(c.FlapThreshold)
+}
+
+// flapWindow returns the period the state changes are counted over
+func (c BackendCheckConfig) flapWindow() time.Duration {
+	if c.FlapWindow == 0 {
+		return DefaultFlapWindow
+	}
+	return time.Duration(c.FlapWindow) * time.Second
+}
+
+// flapPenalty returns how long a flapping backend is kept down
+func (c BackendCheckConfig) flapPenalty() time.Duration {
+	if c.FlapPenalty == 0 {
+		return DefaultFlapPenalty
+	}
+	return time.Duration(c.FlapPenalty) * time.Second
+}
+
+// status returns a snapshot of the health state
+func (h *healthState) status() (status HealthStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	status = HealthStatus{
+		Healthy:   h.healthy,
+		Successes: h.successes,
+		Failures:  h.failures,
+		LastError: h.lastError,
+		History:   append([]HealthEvent{}, h.history...),
+	}
+	if h.checked {
+		lastCheck := h.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	if time.Now().Before(h.dampedUntil) {
+		dampedUntil := h.dampedUntil
+		status.DampedUntil = &dampedUntil
+	}
+
+	return
+}
+
+// record applies the result of a check of the named subject, returns whether the state
+// changed and whether it is healthy now
+func (h *healthState) record(name string, config BackendCheckConfig, err error) (changed, healthy bool) {
+	now := time.Now()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastCheck = now
+	if err == nil {
+		h.successes, h.failures = h.successes+1, 0
+		h.lastError = ""
+	} else {
+		h.successes, h.failures = 0, h.failures+1
+		h.lastError = err.Error()
+	}
+
+	switch {
+	case !h.checked:
+		h.checked, changed = true, true
+		h.change(now, err == nil, err)
+
+	case h.healthy && err != nil && h.failures >= config.fall():
+		log.Warnf("%s is down after %d failed health checks", name, h.failures)
+		changed = true
+		h.change(now, false, err)
+
+	case !h.healthy && err == nil && h.successes >= config.rise():
+		if now.Before(h.dampedUntil) {
+			break
+		}
+
+		// A subject changing its state too often is kept down for the penalty, it comes
+		// back with the first passing check once the penalty is served
+		if h.dampedUntil.IsZero() {
+			if flaps := h.flaps(now.Add(-config.flapWindow())); flaps >= config.flapThreshold() {
+				h.dampedUntil = now.Add(config.flapPenalty())
+				log.Warnf("%s changed its state %d times within %v, damping it until %v",
+					name, flaps, config.flapWindow(), h.dampedUntil.Format(time.RFC3339))
+				break
+			}
+		}
+		h.dampedUntil = time.Time{}
+
+		log.Infof("%s is up after %d passed health checks", name, h.successes)
+		changed = true
+		h.change(now, true, nil)
+	}
+
+	return changed, h.healthy
+}
+
+// Health returns a snapshot of the health check state of the backend
+func (b *Backend) Health() HealthStatus {
+	return b.health.status()
+}
+
+// recordCheck applies the result of a health check to the backend, returns whether its state changed
+func (b *Backend) recordCheck(err error) (changed bool) {
+	changed, healthy := b.health.record("backend "+b.Addr, b.CheckConfig, err)
+
+	// Passing checks of a healthy backend close a breaker opened by failed checks, one tripped
+	// by the passive checks still waits for its trial connections
+	if healthy {
+		b.SetAlive(true)
+	} else if changed {
+		b.SetAlive(false)
+	}
+
+	return
+}
+
+// UDP returns a snapshot of the state of the udp_dns check of the backend, nil without one
+func (b *Backend) UDP() *HealthStatus {
+	if b.CheckConfig.DNS == nil && b.CheckConfig.Type != CheckTypeUDPDNS {
+		return nil
+	}
+
+	status := b.udp.status()
+	return &status
+}
+
+// UDPCapable reports whether the backend is trusted with UDP associations, backends without
+// a udp_dns check are assumed to be
+func (b *Backend) UDPCapable() bool {
+	status := b.UDP()
+	return status == nil || status.Healthy
+}
+
+// recordUDPCheck applies the result of a udp_dns check to the UDP state of the backend,
+// it is tracked apart from the TCP state so that TCP-only backends still take connections
+func (b *Backend) recordUDPCheck(err error) (changed bool) {
+	changed, _ = b.udp.record("UDP relay of backend "+b.Addr, b.CheckConfig, err)
+	return
+}
@@ -0,0 +1,99 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: health_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:15:55
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:15:55
+ */
+
+package socks5lb
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackend_RiseAndFall(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{Rise: 2, Fall: 3})
+	failed := errors.New("check failed")
+
+	// The first check decides on its own
+	assert.True(t, backend.recordCheck(nil))
+	assert.True(t, backend.Alive())
+
+	// Single failures are tolerated until the fall count
+	assert.False(t, backend.recordCheck(failed))
+	assert.False(t, backend.recordCheck(failed))
+	assert.True(t, backend.Alive())
+	assert.False(t, backend.recordCheck(nil))
+	assert.False(t, backend.recordCheck(failed))
+	assert.False(t, backend.recordCheck(failed))
+	assert.True(t, backend.recordCheck(failed))
+	assert.False(t, backend.Alive())
+
+	// The backend comes back after the rise count
+	assert.False(t, backend.recordCheck(nil))
+	assert.False(t, backend.Alive())
+	assert.True(t, backend.recordCheck(nil))
+	assert.True(t, backend.Alive())
+
+	history := backend.Health().History
+	assert.Len(t, history, 3)
+	assert.False(t, history[1].Alive)
+	assert.Equal(t, "check failed", history[1].Reason)
+	assert.True(t, history[2].Alive)
+}
+
+func TestBackend_FlapDamping(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{Rise: 1, Fall: 1, FlapThreshold: 3})
+	failed := errors.New("check failed")
+
+	backend.recordCheck(nil)
+	backend.recordCheck(failed)
+	backend.recordCheck(nil)
+	backend.recordCheck(failed)
+
+	// The third change within the window is suppressed
+	assert.False(t, backend.recordCheck(nil))
+	assert.False(t, backend.Alive())
+	status := backend.Health()
+	assert.NotNil(t, status.DampedUntil)
+	assert.WithinDuration(t, time.Now().Add(DefaultFlapPenalty), *status.DampedUntil, time.Second)
+
+	// It comes back with the first passing check after the penalty
+	backend.health.lock.Lock()
+	backend.health.dampedUntil = time.Now().Add(-time.Second)
+	backend.health.lock.Unlock()
+	assert.True(t, backend.recordCheck(nil))
+	assert.True(t, backend.Alive())
+	assert.Nil(t, backend.Health().DampedUntil)
+}
+
+func TestBackend_HealthHistory(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{Rise: 1, Fall: 1, FlapThreshold: 1000})
+	for i := 0; i < 2*HealthHistorySize; i++ {
+		if i%2 == 0 {
+			backend.recordCheck(nil)
+		} else {
+			backend.recordCheck(errors.New("check failed"))
+		}
+	}
+
+	status := backend.Health()
+	assert.Len(t, status.History, HealthHistorySize)
+	assert.False(t, status.History[HealthHistorySize-1].Alive)
+
+	data, err := json.Marshal(backend)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"health":{"healthy":false`)
+}
@@ -9,7 +9,7 @@
  * File Created: Saturday, July 9th 2022, 7:42:02 pm
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:22:09
+ * Last Modified: 2026-10-18 10:03:43
  */
 
 package socks5lb
@@ -55,6 +55,11 @@ func (s *Server) setupAPIRouter(apiGroup *gin.RouterGroup) (err error) {
 		c.JSON(http.StatusOK, backends)
 	})
 
+	// GET /api/groups - List the backend groups by priority and show which one is in use
+	apiGroup.GET("groups", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Pool.Groups())
+	})
+
 	// DELETE /api/delete - Remove a backend from the pool
 	apiGroup.DELETE("delete", func(c *gin.Context) {
 		addr := c.Query("addr")
@@ -83,8 +88,8 @@ func (s *Server) setupAPIRouter(apiGroup *gin.RouterGroup) (err error) {
 		}
 
 		// Add all backends, fail if any addition fails
-		for _, backend := range backends {
-			err = s.Pool.Add(&backend)
+		for i := range backends {
+			err = s.Pool.Add(&backends[i])
 			if err != nil {
 				c.String(http.StatusServiceUnavailable, err.Error())
 				return
@@ -94,6 +99,46 @@ func (s *Server) setupAPIRouter(apiGroup *gin.RouterGroup) (err error) {
 		c.String(http.StatusOK, fmt.Sprintf("%d backend(s) added", len(backends)))
 	})
 
+	// GET /api/rules - List the routing rules in use
+	apiGroup.GET("rules", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Router.Config())
+	})
+
+	// POST /api/rules/reload - Read the rules file again
+	apiGroup.POST("rules/reload", func(c *gin.Context) {
+		if err := s.Router.Reload(); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c.String(http.StatusOK, fmt.Sprintf("%d rule(s) loaded", len(s.Router.Config().Rules)))
+	})
+
+	// GET /api/rules/explain - Show which rule routes the target host[:port]
+	apiGroup.GET("rules/explain", func(c *gin.Context) {
+		target := c.Query("target")
+		if target == "" {
+			c.String(http.StatusBadRequest, "target is empty")
+			return
+		}
+
+		c.JSON(http.StatusOK, s.Router.Match(target))
+	})
+
+	// GET /api/sessions - List the sticky sessions and their pinned backends
+	apiGroup.GET("sessions", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Sessions.All())
+	})
+
+	// DELETE /api/sessions - Flush a sticky session, or all of them without the session parameter
+	apiGroup.DELETE("sessions", func(c *gin.Context) {
+		session := c.Query("session")
+		log.Tracef("flushing sticky sessions %q", session)
+
+		count := s.Sessions.Flush(session)
+		c.String(http.StatusOK, fmt.Sprintf("%d session(s) flushed", count))
+	})
+
 	return
 }
 
@@ -0,0 +1,306 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: http_proxy.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:47:13
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:01:31
+ */
+
+package socks5lb
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hopHeaders are meaningful for a single connection only and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// bufferedConn reads from the buffered reader which may hold bytes already received
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// ListenHTTPProxy listens on a specific address and handles HTTP proxy connections
+func (s *Server) ListenHTTPProxy(addr string) (err error) {
+	return s.serve("http_proxy", addr, &s.httpProxyListener, s.handleHTTPProxyConnection)
+}
+
+// writeHTTPError writes a minimal HTTP error response to the client
+func writeHTTPError(w io.Writer, code int, header http.Header) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(http.StatusText(code) + "\n")),
+		Close:      true,
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	_ = resp.Write(w)
+}
+
+// httpProxyStatus maps an upstream error to the status code sent back to the client
+func httpProxyStatus(err error) int {
+	if errors.Is(err, ErrRejected) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// httpProxyAuthenticate checks the Proxy-Authorization header against the user store,
+// returns the sticky session carried in the username
+func (s *Server) httpProxyAuthenticate(req *http.Request) (session string, ok bool) {
+	if !s.Users.Enabled() {
+		return "", true
+	}
+
+	scheme, encoded, found := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return "", false
+	}
+
+	_, session, ok = s.authenticate(username, password)
+	return
+}
+
+// httpProxyTransport returns the transport forwarding plain HTTP requests through the backends,
+// idle connections are pooled by target host only so requests whose backend depends on the
+// client get a transport without keep-alive, they would reuse connections of other backends
+func (s *Server) httpProxyTransport(ctx context.Context) *http.Transport {
+	s.httpProxyOnce.Do(func() {
+		s.httpTransport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, backend, err := s.dialUpstream(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				backend.acquire()
+				return &activeConn{Conn: conn, backend: backend}, nil
+			},
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: DefaultDialTimeout * 3,
+			DisableCompression:    true,
+		}
+
+		s.httpPinnedTransport = s.httpTransport.Clone()
+		s.httpPinnedTransport.DisableKeepAlives = true
+	})
+
+	if httpProxyPinned(ctx) {
+		return s.httpPinnedTransport
+	}
+	return s.httpTransport
+}
+
+// activeConn is an upstream connection of the HTTP transports, it counts as active
+// on its backend until the transport closes it
+type activeConn struct {
+	net.Conn
+	backend *Backend
+	once    sync.Once
+}
+
+func (c *activeConn) Close() error {
+	c.once.Do(c.backend.release)
+	return c.Conn.Close()
+}
+
+// httpProxyPinned reports whether the backend of a request is chosen by the client,
+// either by its sticky session or by its IP, rather than by the target alone
+func httpProxyPinned(ctx context.Context) bool {
+	if SessionFrom(ctx) != "" {
+		return true
+	}
+
+	balancer, ok := BalancerFrom(ctx).(*ConsistentHashBalancer)
+	return ok && balancer.ByClientIP
+}
+
+// handleHTTPProxyConnection processes a single HTTP proxy client connection
+func (s *Server) handleHTTPProxyConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Enable TCP keepalive to detect dead connections
+	setKeepAlive(conn)
+
+	// Connections from the mixed listener are buffered already
+	buffered, ok := conn.(*bufferedConn)
+	if !ok {
+		buffered = &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	}
+
+	s.serveHTTPProxy(ctx, buffered)
+}
+
+// serveHTTPProxy serves the requests on a client connection until it is closed
+func (s *Server) serveHTTPProxy(ctx context.Context, conn *bufferedConn) {
+	for {
+		// Limit the time a client may take to send the request head
+		if err := conn.SetReadDeadline(time.Now().Add(DefaultDialTimeout)); err != nil {
+			log.Warnf("failed to set request deadline: %v", err)
+		}
+
+		req, err := http.ReadRequest(conn.reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugf("failed to read HTTP proxy request from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			log.Warnf("failed to clear request deadline: %v", err)
+		}
+
+		session, ok := s.httpProxyAuthenticate(req)
+		if !ok {
+			log.Warnf("HTTP proxy authentication failed for %s", conn.RemoteAddr())
+			writeHTTPError(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", AppName)},
+			})
+			return
+		}
+
+		reqCtx := ctx
+		if session != "" {
+			reqCtx = WithSession(ctx, session)
+		}
+
+		if req.Method == http.MethodConnect {
+			s.handleHTTPConnect(reqCtx, conn, req)
+			return
+		}
+
+		if !s.handleHTTPForward(reqCtx, conn, req) {
+			return
+		}
+	}
+}
+
+// handleHTTPConnect tunnels the connection to the target of a CONNECT request
+func (s *Server) handleHTTPConnect(ctx context.Context, conn *bufferedConn, req *http.Request) {
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+
+	backendConn, backend, err := s.dialUpstream(ctx, "tcp", target)
+	if err != nil {
+		log.Errorf("failed to connect %s: %v", target, err)
+		writeHTTPError(conn, httpProxyStatus(err), nil)
+		return
+	}
+	defer backendConn.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		log.Errorf("failed to reply to %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Tracef("tunneling %s -> %s via backend %s", conn.RemoteAddr(), target, backend.Addr)
+
+	backend.acquire()
+	defer backend.release()
+
+	// Transport data bidirectionally, including anything the client sent ahead
+	if err := s.Transport(conn, backendConn); err != nil {
+		log.Debugf("transport error: %v", err)
+	}
+}
+
+// handleHTTPForward forwards a plain absolute-URI request through a backend,
+// returns whether the client connection can be reused for the next request
+func (s *Server) handleHTTPForward(ctx context.Context, conn *bufferedConn, req *http.Request) bool {
+	if !req.URL.IsAbs() || req.URL.Host == "" {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return false
+	}
+
+	// A group routed to with its own strategy decides whether the backend depends on the client
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		target = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	if balancer := s.Pool.GroupBalancer(s.Router.Match(target).Outbound); balancer != nil {
+		ctx = WithBalancer(ctx, balancer)
+	}
+
+	// Requests read from the wire have to be adjusted before sending them out,
+	// the context lets the dialer pick a backend with the balancer of the listener
+	req = req.WithContext(ctx)
+	req.RequestURI = ""
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+
+	resp, err := s.httpProxyTransport(ctx).RoundTrip(req)
+	if err != nil {
+		log.Errorf("failed to forward %s %s: %v", req.Method, req.URL, err)
+		writeHTTPError(conn, httpProxyStatus(err), nil)
+		return false
+	}
+	defer resp.Body.Close()
+
+	for _, name := range hopHeaders {
+		resp.Header.Del(name)
+	}
+
+	keepAlive := !req.Close && !resp.Close
+	resp.Close = !keepAlive
+
+	if err := resp.Write(conn); err != nil {
+		log.Debugf("failed to write response to %s: %v", conn.RemoteAddr(), err)
+		return false
+	}
+
+	return keepAlive
+}
@@ -0,0 +1,182 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: http_proxy_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:47:13
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:47:13
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startHTTPProxy serves HTTP proxy clients with the given pool and returns the proxy URL
+func startHTTPProxy(t *testing.T, pool *Pool) (*Server, *url.URL) {
+	server, err := NewServer(pool, ServerConfig{})
+	assert.NoError(t, err)
+
+	proxyURL, err := url.Parse("http://" + startTestListener(t, server.handleHTTPProxyConnection))
+	assert.NoError(t, err)
+
+	return server, proxyURL
+}
+
+// proxyClient creates an HTTP client sending every request through the proxy
+func proxyClient(proxyURL *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func TestServer_HTTPProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	})
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	_, proxyURL := startHTTPProxy(t, newTestPool(backend))
+	client := proxyClient(proxyURL)
+
+	// Absolute-URI requests are forwarded, the CONNECT tunnel carries the TLS one
+	for _, target := range []string{plain.URL + "/plain", plain.URL + "/again", secure.URL + "/tunnel"} {
+		resp, err := client.Get(target)
+		assert.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		u, _ := url.Parse(target)
+		assert.Equal(t, "hello "+u.Path, string(body))
+	}
+}
+
+func TestServer_HTTPProxyActiveConns(t *testing.T) {
+	requested, finish := make(chan struct{}), make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-finish
+	}))
+	defer target.Close()
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	server, proxyURL := startHTTPProxy(t, newTestPool(backend))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := proxyClient(proxyURL).Get(target.URL)
+		if assert.NoError(t, err) {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	// The forwarded request is carried by the backend
+	<-requested
+	assert.Equal(t, int64(1), backend.ActiveConns())
+	close(finish)
+	<-done
+
+	// The idle upstream connection is released once the transport closes it
+	server.httpProxyTransport(context.Background()).CloseIdleConnections()
+	assert.Eventually(t, func() bool { return backend.ActiveConns() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_HTTPProxyNoBackend(t *testing.T) {
+	_, proxyURL := startHTTPProxy(t, newTestPool())
+
+	resp, err := proxyClient(proxyURL).Get("http://127.0.0.1:1/")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestServer_HTTPProxyAuthentication(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer target.Close()
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	server, proxyURL := startHTTPProxy(t, newTestPool(backend))
+	server.Users, _ = NewUserStore([]User{{Username: "alice", Password: "secret"}}, "")
+
+	resp, err := proxyClient(proxyURL).Get(target.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	proxyURL.User = url.UserPassword("alice", "secret")
+	resp, err = proxyClient(proxyURL).Get(target.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_HTTPProxyStickySession(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	var backends []*Backend
+	for i := 0; i < 2; i++ {
+		backends = append(backends, NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true}))
+	}
+
+	config := ServerConfig{}
+	config.Sessions.Pattern = `-session-(\w+)`
+	server, err := NewServer(newTestPool(backends...), config)
+	assert.NoError(t, err)
+	server.Users, _ = NewUserStore([]User{{Username: "alice", Password: "secret"}}, "")
+
+	// Sessions are pinned in turn so that the two of them get different backends
+	balancer := &RoundRobinBalancer{}
+	proxyURL, err := url.Parse("http://" + startTestListener(t, func(ctx context.Context, conn net.Conn) {
+		server.handleHTTPProxyConnection(WithBalancer(ctx, balancer), conn)
+	}))
+	assert.NoError(t, err)
+
+	get := func(username string) {
+		proxyURL.User = url.UserPassword(username, "secret")
+		resp, err := proxyClient(proxyURL).Get(target.URL)
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// The second session must not reuse the idle upstream connection of the first one,
+	// its request only reaches the target through a handshake with its own backend
+	get("alice-session-one")
+	get("alice-session-two")
+
+	one, two := server.Sessions.Lookup("alice:one"), server.Sessions.Lookup("alice:two")
+	assert.NotEqual(t, one, two)
+	assert.NotZero(t, two.Latency())
+}
@@ -9,12 +9,13 @@
  * File Created: 2025-10-07 11:08:41
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:23:19
+ * Last Modified: 2026-10-18 10:03:43
  */
 
 package socks5lb
 
 import (
+	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"net/http"
@@ -93,3 +94,97 @@ func TestServer_HTTPPutAndDelete(t *testing.T) {
 	engine.ServeHTTP(w, req)
 	assert.NotEqual(t, http.StatusOK, w.Code)
 }
+
+func TestServer_HTTPPutWeight(t *testing.T) {
+	engine := EngineInstance(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPut, "/api/add", strings.NewReader(`[
+  {
+    "addr": "192.168.120.254:1086",
+    "weight": -1
+  }
+	]`))
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPut, "/api/add", strings.NewReader(`[
+  {
+    "addr": "192.168.121.254:1086",
+    "weight": 5
+  },
+  {
+    "addr": "192.168.122.254:1086"
+  }
+	]`))
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/api/all", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var backends []Backend
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &backends))
+
+	weights := make(map[string]int)
+	for i := range backends {
+		weights[backends[i].Addr] = backends[i].Weight
+	}
+	assert.Equal(t, 5, weights["192.168.121.254:1086"])
+	assert.Equal(t, DefaultWeight, weights["192.168.122.254:1086"])
+	assert.NotContains(t, weights, "192.168.120.254:1086")
+	assert.Contains(t, w.Body.String(), `"active_connections":0`)
+}
+
+func TestServer_HTTPSessions(t *testing.T) {
+	engine := EngineInstance(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/sessions", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/api/sessions", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0 session(s) flushed", w.Body.String())
+}
+
+func TestServer_HTTPRules(t *testing.T) {
+	engine := EngineInstance(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/rules/explain?target=example.com:443", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"target":"example.com:443","index":-1,"outbound":""}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/api/rules/explain", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/api/rules/reload", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0 rule(s) loaded", w.Body.String())
+}
+
+func TestServer_HTTPGroups(t *testing.T) {
+	engine := EngineInstance(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/groups", nil)
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var groups []GroupStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &groups))
+	assert.NotEmpty(t, groups)
+}
@@ -0,0 +1,58 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: mixed.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:48:15
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:51:12
+ */
+
+package socks5lb
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/txthinking/socks5"
+)
+
+// ListenMixed listens on a specific address and serves SOCKS5, SOCKS4/4a and HTTP proxy
+// clients on the same port, the protocol is detected from the first byte of the connection
+func (s *Server) ListenMixed(addr string) (err error) {
+	return s.serve("mixed", addr, &s.mixedListener, s.handleMixedConnection)
+}
+
+// handleMixedConnection peeks the first byte and dispatches the connection to its handler
+func (s *Server) handleMixedConnection(ctx context.Context, conn net.Conn) {
+	// Limit the time a client may take to send anything
+	if err := conn.SetReadDeadline(time.Now().Add(DefaultDialTimeout)); err != nil {
+		log.Warnf("failed to set handshake deadline: %v", err)
+	}
+
+	// Bytes peeked here stay in the buffer for the protocol handler
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(1)
+	if err != nil {
+		log.Debugf("failed to detect protocol of %s: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	buffered := &bufferedConn{Conn: conn, reader: reader}
+	switch head[0] {
+	case socks5.Ver:
+		s.handleSocks5Connection(ctx, buffered)
+	case Socks4Version:
+		s.handleSocks4Connection(ctx, buffered)
+	default:
+		s.handleHTTPProxyConnection(ctx, buffered)
+	}
+}
@@ -0,0 +1,63 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: mixed_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:48:15
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:48:54
+ */
+
+package socks5lb
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+func TestServer_Mixed(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "mixed")
+	}))
+	defer target.Close()
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	server, err := NewServer(newTestPool(backend), ServerConfig{})
+	assert.NoError(t, err)
+	addr := startTestListener(t, server.handleMixedConnection)
+
+	// SOCKS5
+	client, err := socks5.NewClient(addr, "", "", 5, 5)
+	assert.NoError(t, err)
+	conn, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	assertEcho(t, conn, "socks5 over mixed")
+	_ = conn.Close()
+
+	// SOCKS4
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	assert.Equal(t, Socks4RepGranted, socks4Connect(t, conn, echoAddr, "", ""))
+	assertEcho(t, conn, "socks4 over mixed")
+	_ = conn.Close()
+
+	// HTTP proxy
+	proxyURL, _ := url.Parse("http://" + addr)
+	resp, err := proxyClient(proxyURL).Get(target.URL)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, "mixed", string(body))
+}
@@ -0,0 +1,164 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: passive.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:03:43
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:07:37
+ */
+
+package socks5lb
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/txthinking/socks5"
+)
+
+const (
+	// DefaultPassiveWindow is the length of the window the failure rate is computed over
+	DefaultPassiveWindow = 60 * time.Second
+	// DefaultPassiveMinRequests is the number of attempts in a window before the failure rate applies
+	DefaultPassiveMinRequests = 10
+)
+
+// PassiveHealthConfig ejects backends failing real client connections, independently of the health checks
+type PassiveHealthConfig struct {
+	MaxFailures uint    `yaml:"max_failures"` // consecutive failures ejecting a backend, 0 disables
+	FailureRate float64 `yaml:"failure_rate"` // share of failed attempts in the window ejecting a backend, 0 disables
+	Window      uint    `yaml:"window"`       // seconds of the failure rate window, default 60
+	MinRequests uint    `yaml:"min_requests"` // attempts in the window before the failure rate applies, default 10
+
+	// Ejected backends are tried again by a few trial connections after a back-off
+	OpenTimeout    uint `yaml:"open_timeout"`     // seconds before the first trial, default 30
+	MaxOpenTimeout uint `yaml:"max_open_timeout"` // seconds the back-off doubles up to with failed trials, default 300
+	HalfOpenTrials uint `yaml:"half_open_trials"` // concurrent trial connections, default 1
+}
+
+// Enabled reports whether any ejection threshold is configured
+func (c PassiveHealthConfig) Enabled() bool {
+	return c.MaxFailures > 0 || c.FailureRate > 0
+}
+
+// passiveHealth counts the outcomes of the connections through a backend
+type passiveHealth struct {
+	consecutive uint
+
+	// Outcomes within the current window, the window restarts once it elapsed
+	windowStart time.Time
+	successes   uint
+	failures    uint
+
+	lock sync.Mutex
+}
+
+// roll starts a new window if the current one elapsed, the caller must hold the lock
+func (p *passiveHealth) roll(window time.Duration) {
+	if now := time.Now(); now.Sub(p.windowStart) >= window {
+		p.windowStart, p.successes, p.failures = now, 0, 0
+	}
+}
+
+// reset forgets all outcomes, the caller must hold the lock
+func (p *passiveHealth) reset() {
+	p.consecutive, p.successes, p.failures = 0, 0, 0
+	p.windowStart = time.Now()
+}
+
+// backendFault reports whether the error of an attempt is caused by the backend itself,
+// replies about the target only show that the backend works
+func backendFault(err error) bool {
+	var replyErr *Socks5ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Rep == socks5.RepServerFailure || replyErr.Rep == socks5.RepNetworkUnreachable
+	}
+
+	return err != nil
+}
+
+// ConsecutiveFailures returns the number of client connections failed in a row through the backend
+func (b *Backend) ConsecutiveFailures() uint {
+	b.passive.lock.Lock()
+	defer b.passive.lock.Unlock()
+	return b.passive.consecutive
+}
+
+// ReportSuccess records a client connection which went through the backend
+func (b *Backend) ReportSuccess(config PassiveHealthConfig) {
+	window := time.Duration(config.Window) * time.Second
+	if window == 0 {
+		window = DefaultPassiveWindow
+	}
+
+	b.passive.lock.Lock()
+	defer b.passive.lock.Unlock()
+
+	b.passive.roll(window)
+	b.passive.consecutive = 0
+	b.passive.successes++
+}
+
+// ReportFailure records a client connection which failed because of the backend,
+// returns whether the backend got ejected from the rotation
+func (b *Backend) ReportFailure(config PassiveHealthConfig) (ejected bool) {
+	window := time.Duration(config.Window) * time.Second
+	if window == 0 {
+		window = DefaultPassiveWindow
+	}
+
+	minRequests := config.MinRequests
+	if minRequests == 0 {
+		minRequests = DefaultPassiveMinRequests
+	}
+
+	b.passive.lock.Lock()
+	defer b.passive.lock.Unlock()
+
+	b.passive.roll(window)
+	b.passive.consecutive++
+	b.passive.failures++
+
+	consecutive, total := b.passive.consecutive, b.passive.successes+b.passive.failures
+	rate := float64(b.passive.failures) / float64(total)
+
+	switch {
+	case config.MaxFailures > 0 && consecutive >= config.MaxFailures:
+		log.Warnf("ejecting backend %s after %d consecutive failures", b.Addr, consecutive)
+	case config.FailureRate > 0 && total >= minRequests && rate >= config.FailureRate:
+		log.Warnf("ejecting backend %s with a failure rate of %.2f over %d attempts", b.Addr, rate, total)
+	default:
+		return false
+	}
+
+	// The backend starts over once its trial connections bring it back
+	b.passive.reset()
+	b.Trip(config)
+	return true
+}
+
+// reportAttempt feeds the outcome of an upstream attempt into the circuit breaker
+// and the passive health of the backend
+func (s *Server) reportAttempt(backend *Backend, err error) {
+	config := s.Config.PassiveHealth
+	trial := backend.reportTrial(!backendFault(err), config)
+
+	if !config.Enabled() {
+		return
+	}
+
+	switch {
+	case err == nil:
+		backend.ReportSuccess(config)
+	case backendFault(err) && !trial:
+		// A failed trial reopened the breaker with the doubled back-off already
+		backend.ReportFailure(config)
+	}
+}
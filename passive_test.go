@@ -0,0 +1,121 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: passive_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:03:43
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:03:43
+ */
+
+package socks5lb
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+func TestBackend_PassiveConsecutiveFailures(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	config := PassiveHealthConfig{MaxFailures: 3}
+
+	assert.False(t, backend.ReportFailure(config))
+	assert.False(t, backend.ReportFailure(config))
+
+	// A success breaks the streak
+	backend.ReportSuccess(config)
+	assert.Zero(t, backend.ConsecutiveFailures())
+
+	assert.False(t, backend.ReportFailure(config))
+	assert.False(t, backend.ReportFailure(config))
+	assert.True(t, backend.Alive())
+	assert.True(t, backend.ReportFailure(config))
+	assert.False(t, backend.Alive())
+	assert.Zero(t, backend.ConsecutiveFailures())
+}
+
+func TestBackend_PassiveFailureRate(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+	config := PassiveHealthConfig{FailureRate: 0.5, MinRequests: 6}
+
+	// The rate only applies after enough attempts
+	for i := 0; i < 2; i++ {
+		backend.ReportSuccess(config)
+		assert.False(t, backend.ReportFailure(config))
+	}
+	backend.ReportSuccess(config)
+	assert.True(t, backend.Alive())
+
+	assert.True(t, backend.ReportFailure(config))
+	assert.False(t, backend.Alive())
+}
+
+func TestBackendFault(t *testing.T) {
+	assert.True(t, backendFault(errors.New("connection reset")))
+	assert.True(t, backendFault(&Socks5ReplyError{Rep: socks5.RepServerFailure}))
+	assert.False(t, backendFault(&Socks5ReplyError{Rep: socks5.RepConnectionRefused}))
+	assert.False(t, backendFault(&Socks5ReplyError{Rep: socks5.RepHostUnreachable}))
+	assert.False(t, backendFault(nil))
+}
+
+func TestServer_Socks5PassiveEjection(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	// Nothing listens on the address of the dead backend
+	dead := NewBackend(freeAddr(t), BackendCheckConfig{InitialAlive: true})
+	alive := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	config := ServerConfig{}
+	config.PassiveHealth.MaxFailures = 1
+	server, err := NewServer(newTestPool(dead, alive), config)
+	assert.NoError(t, err)
+	addr := startTestListener(t, server.handleSocks5Connection)
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+
+		socks5Handshake(t, conn, socks5.CmdConnect, echoAddr)
+		reply, err := socks5.NewReplyFrom(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, socks5.RepSuccess, reply.Rep)
+		_ = conn.Close()
+	}
+
+	// The first failed attempt took the dead backend out of rotation
+	assert.False(t, dead.Alive())
+	assert.True(t, alive.Alive())
+}
+
+func TestServer_ReportFailedTrial(t *testing.T) {
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{InitialAlive: true})
+
+	config := ServerConfig{}
+	config.PassiveHealth = PassiveHealthConfig{MaxFailures: 1, OpenTimeout: 10, MaxOpenTimeout: 100}
+	server, err := NewServer(newTestPool(backend), config)
+	assert.NoError(t, err)
+
+	server.reportAttempt(backend, errors.New("connection reset"))
+	assert.Equal(t, uint(1), backend.Breaker().Trips)
+
+	// Failed trials double the back-off without the passive checks tripping it again
+	for i, expected := range []time.Duration{20 * time.Second, 40 * time.Second, 80 * time.Second} {
+		backend.breaker.lock.Lock()
+		backend.breaker.retryAt = time.Now()
+		backend.breaker.lock.Unlock()
+
+		assert.True(t, backend.allow())
+		server.reportAttempt(backend, errors.New("connection reset"))
+		assert.Equal(t, expected, backend.breaker.backoff)
+		assert.Equal(t, uint(i+2), backend.Breaker().Trips)
+	}
+}
@@ -9,27 +9,38 @@
  * File Created: Tuesday, June 21st 2022, 6:03:26 pm
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:22:29
+ * Last Modified: 2026-10-18 10:26:59
  */
 
 package socks5lb
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
-	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Pool struct {
-	current  uint64
-	backends map[string]*Backend
-	lock     sync.RWMutex // Use RWMutex for better read concurrency
+	backends  map[string]*Backend
+	groups    map[string]Group    // the declared groups by name
+	balancers map[string]Balancer // balancers of the groups with a strategy
+	lock      sync.RWMutex        // Use RWMutex for better read concurrency
+	weighted  WeightedRoundRobinBalancer
 }
 
-// Add add a backend to the pool
+// Add add a backend to the pool, a backend without weight gets DefaultWeight
 func (b *Pool) Add(backend *Backend) (err error) {
+	if backend.Weight < 0 {
+		return fmt.Errorf("weight of %v must not be negative", backend.Addr)
+	}
+	if backend.Weight == 0 {
+		backend.Weight = DefaultWeight
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	if b.backends[backend.Addr] != nil {
@@ -37,6 +48,7 @@ func (b *Pool) Add(backend *Backend) (err error) {
 	}
 
 	b.backends[backend.Addr] = backend
+	backend.removed.Store(false)
 	return
 }
 
@@ -48,6 +60,7 @@ func (b *Pool) Remove(addr string) (err error) {
 	if b.backends[addr] == nil {
 		return fmt.Errorf("server %s is not exists", addr)
 	}
+	b.backends[addr].removed.Store(true)
 	delete(b.backends, addr)
 	return
 }
@@ -81,75 +94,78 @@ func (b *Pool) AllHealthy() (backends []*Backend) {
 	return
 }
 
-// NextIndex returns the next index for load balancer round-robin algorithm
-// Uses atomic operations for thread-safe index management
-func (b *Pool) NextIndex() int {
-	b.lock.RLock()
-	backendCount := len(b.backends)
-	b.lock.RUnlock()
-
-	if backendCount == 0 {
-		return 0
-	}
+// Next returns the next available healthy backend using weighted round-robin algorithm
+// Returns nil if no healthy backend is available
+func (b *Pool) Next() *Backend {
+	return b.NextExclude()
+}
 
-	return int(atomic.AddUint64(&b.current, uint64(1)) % uint64(backendCount))
+// NextExclude works like Next but skips the given backends
+func (b *Pool) NextExclude(excludes ...*Backend) *Backend {
+	return b.Pick(context.Background(), nil, excludes...)
 }
 
-// Next returns the next available healthy backend using round-robin algorithm
-// Returns nil if no healthy backend is available
-func (b *Pool) Next() *Backend {
+// Pick selects a healthy backend matching the context with the balancer, skipping the excluded ones
+func (b *Pool) Pick(ctx context.Context, balancer Balancer, excludes ...*Backend) *Backend {
 	// Get all healthy backends
 	backends := b.AllHealthy()
 	log.Tracef("found %d available backends", len(backends))
 
-	// No backends available
-	if len(backends) <= 0 {
-		return nil
-	}
-
-	// Get starting index for round-robin
-	next := b.NextIndex()
+	// Drop the excluded backends and the ones the context does not accept
+	group, udp, exit := GroupFrom(ctx), UDPFrom(ctx), ExitFrom(ctx)
+	if len(excludes) > 0 || group != "" || udp || !exit.Empty() {
+		candidates := backends[:0]
+		for _, backend := range backends {
+			if slices.Contains(excludes, backend) {
+				continue
+			}
 
-	// Loop through all backends starting from next index
-	l := len(backends) + next
+			// Contexts with a group only get the backends of that group
+			if group != "" && backend.Group != group {
+				continue
+			}
 
-	for i := next; i < l; i++ {
-		// Get index using modulo to wrap around
-		idx := i % len(backends)
+			// UDP associations need a backend whose relay is not known to be broken
+			if udp && !backend.UDPCapable() {
+				continue
+			}
 
-		// Return the first alive backend found
-		if backends[idx].Alive() {
-			// Update current index only if we moved from original position
-			if i != next {
-				atomic.StoreUint64(&b.current, uint64(idx))
+			// Routing rules may restrict the country or autonomous system of the exit IP
+			if !exit.Match(backend.Exit()) {
+				continue
 			}
 
-			return backends[idx]
+			candidates = append(candidates, backend)
 		}
+		backends = candidates
 	}
 
-	return nil
-}
+	// Without a group, lower tiers are only used while the preferred ones have no candidates
+	if group == "" {
+		backends = b.preferredTier(backends)
+	}
 
-// Check performs health checks on all backends in the pool
-func (b *Pool) Check() {
-	b.lock.RLock()
-	// Create a snapshot of backends to avoid holding lock during checks
-	backends := make([]*Backend, 0, len(b.backends))
-	for _, backend := range b.backends {
-		backends = append(backends, backend)
+	// No backends available
+	if len(backends) <= 0 {
+		return nil
 	}
-	b.lock.RUnlock()
 
-	// Perform health checks without holding the lock
-	for _, backend := range backends {
-		err := backend.Check()
-		if err != nil {
-			log.Errorf("health check failed for backend %s: %v", backend.Addr, err)
-		} else {
-			log.Debugf("health check successful for backend %s", backend.Addr)
-		}
+	// Map iteration order is random, sort so that stateful balancers see a stable order
+	slices.SortFunc(backends, func(x, y *Backend) int {
+		return strings.Compare(x.Addr, y.Addr)
+	})
+
+	// Fall back to smooth weighted round-robin without a balancer
+	if balancer == nil {
+		balancer = &b.weighted
 	}
+
+	return balancer.Pick(ctx, backends)
+}
+
+// Check performs one round of health checks on all backends in the pool
+func (b *Pool) Check() {
+	NewCheckScheduler(b, HealthCheckConfig{}, nil).CheckAll()
 }
 
 var (
@@ -166,8 +182,8 @@ func NewPool(backends ...[]Backend) *Pool {
 	})
 
 	for _, backend := range backends {
-		for _, b := range backend {
-			if err := instance.Add(&b); err != nil {
+		for i := range backend {
+			if err := instance.Add(&backend[i]); err != nil {
 				log.Error(err)
 			}
 		}
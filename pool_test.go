@@ -9,7 +9,7 @@
  * File Created: 2025-10-07 11:08:41
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:23:25
+ * Last Modified: 2026-10-18 09:55:09
  */
 
 package socks5lb
@@ -54,7 +54,6 @@ func TestPool_HealthCheck(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		b := pool.Next()
 		if b != nil {
-			fmt.Printf("%v | ", pool.current)
 			fmt.Printf("%v\n", b)
 		}
 	}
@@ -76,3 +75,39 @@ func TestPool_NextCheck(t *testing.T) {
 		assert.NotNil(t, next)
 	}
 }
+
+func TestPool_NextExclude(t *testing.T) {
+	first := NewBackend("127.0.0.1:1081", BackendCheckConfig{InitialAlive: true})
+	second := NewBackend("127.0.0.1:1082", BackendCheckConfig{InitialAlive: true})
+	pool := newTestPool(first, second)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, second, pool.NextExclude(first))
+		assert.Equal(t, first, pool.NextExclude(second))
+	}
+
+	assert.Nil(t, pool.NextExclude(first, second))
+}
+
+func TestPool_Weight(t *testing.T) {
+	pool := newTestPool()
+
+	heavy := NewBackend("127.0.0.1:1081", BackendCheckConfig{InitialAlive: true})
+	heavy.Weight = 3
+	assert.NoError(t, pool.Add(heavy))
+
+	light := &Backend{Addr: "127.0.0.1:1082"}
+	light.SetAlive(true)
+	assert.NoError(t, pool.Add(light))
+	assert.Equal(t, DefaultWeight, light.Weight)
+
+	assert.Error(t, pool.Add(&Backend{Addr: "127.0.0.1:1083", Weight: -1}))
+
+	counts := make(map[*Backend]int)
+	for i := 0; i < 40; i++ {
+		counts[pool.Next()]++
+	}
+
+	assert.Equal(t, 30, counts[heavy])
+	assert.Equal(t, 10, counts[light])
+}
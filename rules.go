@@ -0,0 +1,313 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: rules.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:01:31
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:26:59
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// OutboundDirect connects to the target without any backend
+	OutboundDirect = "DIRECT"
+	// OutboundReject refuses the connection to the target
+	OutboundReject = "REJECT"
+)
+
+// ErrRejected is returned when a routing rule rejects the target
+var ErrRejected = errors.New("connection rejected by rule")
+
+type groupKey struct{}
+
+// WithGroup returns a context restricting the backends to the named group
+func WithGroup(ctx context.Context, group string) context.Context {
+	return context.WithValue(ctx, groupKey{}, group)
+}
+
+// GroupFrom returns the backend group of the context, empty means all backends
+func GroupFrom(ctx context.Context) string {
+	group, _ := ctx.Value(groupKey{}).(string)
+	return group
+}
+
+// RuleConfig declares a routing rule, the target matches when its host matches any of the
+// domain or IP matchers (or no such matcher is given) and its port is in one of the ranges
+type RuleConfig struct {
+	Name          string   `yaml:"name" json:"name,omitempty"`
+	Domain        []string `yaml:"domain" json:"domain,omitempty"`
+	DomainSuffix  []string `yaml:"domain_suffix" json:"domain_suffix,omitempty"`
+	DomainKeyword []string `yaml:"domain_keyword" json:"domain_keyword,omitempty"`
+	DomainRegex   []string `yaml:"domain_regex" json:"domain_regex,omitempty"`
+	IPCIDR        []string `yaml:"ip_cidr" json:"ip_cidr,omitempty"`
+	Port          []string `yaml:"port" json:"port,omitempty"` // single ports like "443" or ranges like "8000-9000"
+
+	// Outbound is a backend group name, DIRECT or REJECT, empty means all backends with an exit filter
+	Outbound string `yaml:"outbound" json:"outbound"`
+
+	// Backends are restricted to the ones egressing from these countries and autonomous systems
+	ExitCountry []string `yaml:"exit_country" json:"exit_country,omitempty"`
+	ExitASN     []uint   `yaml:"exit_asn" json:"exit_asn,omitempty"`
+}
+
+// RulesConfig is the content of the rules file
+type RulesConfig struct {
+	Rules []RuleConfig `yaml:"rules" json:"rules"`
+	// Final is the outbound of targets matching no rule, empty means all backends
+	Final string `yaml:"final" json:"final"`
+}
+
+// Route explains how a target is routed
+type Route struct {
+	Target   string `json:"target"`
+	Index    int    `json:"index"` // position of the matched rule, -1 if no rule matched
+	Rule     string `json:"rule,omitempty"`
+	Matcher  string `json:"matcher,omitempty"`
+	Outbound string `json:"outbound"`
+	ExitFilter
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	from, to uint16
+}
+
+// rule is a compiled RuleConfig
+type rule struct {
+	RuleConfig
+	regexes []*regexp.Regexp
+	cidrs   []*net.IPNet
+	ports   []portRange
+}
+
+// parsePortRange parses "443" or "8000-9000"
+func parsePortRange(spec string) (r portRange, err error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+	if !isRange {
+		to = from
+	}
+
+	first, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return r, fmt.Errorf("invalid port %q", spec)
+	}
+
+	last, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || last < first {
+		return r, fmt.Errorf("invalid port range %q", spec)
+	}
+
+	return portRange{from: uint16(first), to: uint16(last)}, nil
+}
+
+// newRule compiles the matchers of the rule configuration
+func newRule(config RuleConfig) (r *rule, err error) {
+	if config.Outbound == "" && len(config.ExitCountry)+len(config.ExitASN) == 0 {
+		return nil, errors.New("outbound is missing")
+	}
+	if len(config.ExitCountry)+len(config.ExitASN) > 0 && (config.Outbound == OutboundDirect || config.Outbound == OutboundReject) {
+		return nil, fmt.Errorf("exit filters do not apply to %s", config.Outbound)
+	}
+
+	r = &rule{RuleConfig: config}
+
+	for _, expr := range config.DomainRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain_regex: %w", err)
+		}
+		r.regexes = append(r.regexes, re)
+	}
+
+	for _, cidr := range config.IPCIDR {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip_cidr: %w", err)
+		}
+		r.cidrs = append(r.cidrs, network)
+	}
+
+	for _, spec := range config.Port {
+		portRange, err := parsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, portRange)
+	}
+
+	return
+}
+
+// matchHost returns the matcher accepting the host, empty if none does
+func (r *rule) matchHost(host string) (matcher string, ok bool) {
+	if len(r.Domain)+len(r.DomainSuffix)+len(r.DomainKeyword)+len(r.regexes)+len(r.cidrs) == 0 {
+		return "any", true
+	}
+
+	// IP targets are only matched by CIDRs, domains are never resolved locally
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range r.cidrs {
+			if network.Contains(ip) {
+				return "ip_cidr " + network.String(), true
+			}
+		}
+		return "", false
+	}
+
+	for _, domain := range r.Domain {
+		if strings.EqualFold(host, strings.TrimSuffix(domain, ".")) {
+			return "domain " + domain, true
+		}
+	}
+
+	for _, suffix := range r.DomainSuffix {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return "domain_suffix " + suffix, true
+		}
+	}
+
+	for _, keyword := range r.DomainKeyword {
+		if strings.Contains(host, strings.ToLower(keyword)) {
+			return "domain_keyword " + keyword, true
+		}
+	}
+
+	for _, re := range r.regexes {
+		if re.MatchString(host) {
+			return "domain_regex " + re.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// matchPort reports whether the port is in the ranges of the rule, any port if there are none
+func (r *rule) matchPort(port uint16) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+
+	for _, portRange := range r.ports {
+		if port >= portRange.from && port <= portRange.to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Router routes targets to backend groups, DIRECT or REJECT with the rules of a YAML file
+type Router struct {
+	path string
+
+	config RulesConfig
+	rules  []*rule
+	lock   sync.RWMutex
+}
+
+// Reload reads the rules file again, the current rules are kept if it is invalid
+func (r *Router) Reload() (err error) {
+	config := RulesConfig{}
+	if r.path != "" {
+		data, err := os.ReadFile(r.path)
+		if err != nil {
+			return err
+		}
+
+		if err = yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("%s: %w", r.path, err)
+		}
+	}
+
+	rules := make([]*rule, 0, len(config.Rules))
+	for i, ruleConfig := range config.Rules {
+		compiled, err := newRule(ruleConfig)
+		if err != nil {
+			return fmt.Errorf("%s: rule %d: %w", r.path, i, err)
+		}
+		rules = append(rules, compiled)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.config, r.rules = config, rules
+	return
+}
+
+// Config returns the rules which are currently in use
+func (r *Router) Config() RulesConfig {
+	if r == nil {
+		return RulesConfig{Rules: []RuleConfig{}}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	config := r.config
+	config.Rules = append([]RuleConfig{}, r.config.Rules...)
+	return config
+}
+
+// Match routes the target host:port with the first matching rule
+func (r *Router) Match(target string) (route Route) {
+	route = Route{Target: target, Index: -1}
+	if r == nil {
+		return
+	}
+
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	port, _ := strconv.ParseUint(portString, 10, 16)
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for i, rule := range r.rules {
+		if !rule.matchPort(uint16(port)) {
+			continue
+		}
+
+		if matcher, ok := rule.matchHost(host); ok {
+			route.Index, route.Rule, route.Matcher, route.Outbound = i, rule.Name, matcher, rule.Outbound
+			route.ExitFilter = ExitFilter{Countries: rule.ExitCountry, ASNs: rule.ExitASN}
+			return
+		}
+	}
+
+	route.Outbound = r.config.Final
+	return
+}
+
+// NewRouter creates a router with the rules of the YAML file, no file means no rules
+func NewRouter(path string) (router *Router, err error) {
+	router = &Router{path: path}
+	if err = router.Reload(); err != nil {
+		return nil, err
+	}
+
+	return
+}
@@ -0,0 +1,272 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: rules_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:01:31
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:01:31
+ */
+
+package socks5lb
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+const testRules = `
+final: default
+rules:
+  - name: ads
+    domain_suffix: [doubleclick.net]
+    domain_keyword: [adservice]
+    outbound: REJECT
+  - name: api
+    domain: [api.example.com]
+    domain_regex: ['^cdn\d+\.example\.org$']
+    outbound: residential
+  - name: lan
+    ip_cidr: [10.0.0.0/8, "fd00::/8"]
+    outbound: DIRECT
+  - name: mail
+    port: [25, "465-587"]
+    outbound: mail
+`
+
+// writeRules writes the rules into a temporary file and returns its path
+func writeRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	assert.NoError(t, os.WriteFile(path, []byte(rules), 0600))
+	return path
+}
+
+func TestRouter_Match(t *testing.T) {
+	router, err := NewRouter(writeRules(t, testRules))
+	assert.NoError(t, err)
+
+	for target, outbound := range map[string]string{
+		"doubleclick.net:443":         OutboundReject,
+		"stats.g.doubleclick.net:443": OutboundReject,
+		"notdoubleclick.net:443":      "default",
+		"pagead.adservice.com:80":     OutboundReject,
+		"API.example.com.:443":        "residential",
+		"www.api.example.com:443":     "default",
+		"cdn12.example.org:443":       "residential",
+		"10.1.2.3:22":                 OutboundDirect,
+		"[fd00::1]:22":                OutboundDirect,
+		"11.1.2.3:22":                 "default",
+		"smtp.example.net:25":         "mail",
+		"smtp.example.net:587":        "mail",
+		"smtp.example.net:588":        "default",
+		"10.1.2.3":                    OutboundDirect,
+	} {
+		assert.Equal(t, outbound, router.Match(target).Outbound, target)
+	}
+
+	route := router.Match("cdn1.example.org:443")
+	assert.Equal(t, 1, route.Index)
+	assert.Equal(t, "api", route.Rule)
+	assert.Equal(t, `domain_regex ^cdn\d+\.example\.org$`, route.Matcher)
+
+	route = router.Match("example.net:80")
+	assert.Equal(t, -1, route.Index)
+	assert.Equal(t, "default", route.Outbound)
+
+	// Without a rules file everything goes to all backends
+	var empty *Router
+	assert.Equal(t, "", empty.Match("example.net:80").Outbound)
+	router, err = NewRouter("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", router.Match("example.net:80").Outbound)
+}
+
+func TestRouter_Reload(t *testing.T) {
+	path := writeRules(t, testRules)
+	router, err := NewRouter(path)
+	assert.NoError(t, err)
+	assert.Len(t, router.Config().Rules, 4)
+
+	assert.NoError(t, os.WriteFile(path, []byte("rules:\n  - domain: [example.com]\n    outbound: REJECT\n"), 0600))
+	assert.NoError(t, router.Reload())
+	assert.Len(t, router.Config().Rules, 1)
+	assert.Equal(t, OutboundReject, router.Match("example.com:443").Outbound)
+
+	// Broken files keep the rules in use
+	for _, rules := range []string{
+		"rules:\n  - domain: [example.com]\n",
+		"rules:\n  - domain_regex: ['(']\n    outbound: REJECT\n",
+		"rules:\n  - ip_cidr: [10.0.0.0/33]\n    outbound: REJECT\n",
+		"rules:\n  - port: [9000-8000]\n    outbound: REJECT\n",
+		"rules: [",
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(rules), 0600))
+		assert.Error(t, router.Reload(), rules)
+		assert.Len(t, router.Config().Rules, 1)
+	}
+
+	_, err = NewRouter(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestServer_Socks5Rules(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	residential := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	residential.Group = "residential"
+	other := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	config := ServerConfig{}
+	config.Rules.File = writeRules(t, `
+rules:
+  - domain: [blocked.test]
+    outbound: REJECT
+  - domain: [localhost]
+    outbound: residential
+  - ip_cidr: [127.0.0.0/8]
+    outbound: DIRECT
+`)
+	server, err := NewServer(newTestPool(residential, other), config)
+	assert.NoError(t, err)
+	addr := startTestListener(t, server.handleSocks5Connection)
+
+	connect := func(target string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		socks5Handshake(t, conn, socks5.CmdConnect, target)
+		reply, err := socks5.NewReplyFrom(conn)
+		assert.NoError(t, err)
+		return conn, reply.Rep
+	}
+
+	_, rep := connect("blocked.test:443")
+	assert.Equal(t, socks5.RepNotAllowed, rep)
+
+	// Only the backend of the group carries the target
+	conn, rep := connect(net.JoinHostPort("localhost", echoPort))
+	assert.Equal(t, socks5.RepSuccess, rep)
+	assertEcho(t, conn, "via residential")
+	assert.Equal(t, int64(1), residential.ActiveConns())
+	assert.Zero(t, other.ActiveConns())
+
+	// Direct targets do not need any backend
+	residential.SetAlive(false)
+	other.SetAlive(false)
+	conn, rep = connect(echoAddr)
+	assert.Equal(t, socks5.RepSuccess, rep)
+	assertEcho(t, conn, "direct")
+}
+
+func TestServer_Socks5RulesGroupStrategy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	backends := []*Backend{
+		NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true}),
+		NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true}),
+	}
+	backends[0].Group, backends[1].Group = "residential", "residential"
+
+	pool := newTestPool(backends...)
+	assert.NoError(t, pool.SetGroups([]Group{{Name: "residential", Strategy: StrategyConsistentHash}}))
+
+	config := ServerConfig{}
+	config.Rules.File = writeRules(t, `
+rules:
+  - domain: [localhost]
+    outbound: residential
+`)
+	server, err := NewServer(pool, config)
+	assert.NoError(t, err)
+	addr := startTestListener(t, server.handleSocks5Connection)
+
+	// The listener alternates between the backends, the group sticks to one by target
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		socks5Handshake(t, conn, socks5.CmdConnect, net.JoinHostPort("localhost", echoPort))
+		reply, err := socks5.NewReplyFrom(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, socks5.RepSuccess, reply.Rep)
+		assertEcho(t, conn, "via residential")
+	}
+
+	assert.ElementsMatch(t, []int64{0, 4}, []int64{backends[0].ActiveConns(), backends[1].ActiveConns()})
+}
+
+func TestServer_Socks5RulesBindAndUDP(t *testing.T) {
+	udpEcho, blockedEcho := startUDPEchoServer(t), startUDPEchoServer(t)
+	_, blockedPort, _ := net.SplitHostPort(blockedEcho)
+
+	// Only the backend of the group serves BIND, the other one refuses the command
+	residential := NewBackend(startBindBackend(t), BackendCheckConfig{InitialAlive: true})
+	residential.Group = "residential"
+	other := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	config := ServerConfig{}
+	config.Rules.File = writeRules(t, `
+rules:
+  - domain: [blocked.test]
+    outbound: REJECT
+  - port: ["`+blockedPort+`"]
+    outbound: REJECT
+  - domain: [localhost]
+    outbound: residential
+`)
+	server, err := NewServer(newTestPool(residential, other), config)
+	assert.NoError(t, err)
+	addr := startTestListener(t, server.handleSocks5Connection)
+
+	bind := func(target string) byte {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		socks5Handshake(t, conn, socks5.CmdBind, target)
+		reply, err := socks5.NewReplyFrom(conn)
+		assert.NoError(t, err)
+		return reply.Rep
+	}
+
+	assert.Equal(t, socks5.RepNotAllowed, bind("blocked.test:21"))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, socks5.RepSuccess, bind("localhost:21"))
+	}
+
+	// Datagrams to rejected targets are dropped, the others are relayed by a UDP capable backend
+	server, err = NewServer(newTestPool(other), config)
+	assert.NoError(t, err)
+	client, err := socks5.NewClient(startTestListener(t, server.handleSocks5Connection), "", "", 5, 5)
+	assert.NoError(t, err)
+
+	exchange := func(target string) error {
+		conn, err := client.Dial("udp", target)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("datagram"))
+		assert.NoError(t, err)
+
+		_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = conn.Read(make([]byte, MaxUDPPacketSize))
+		return err
+	}
+
+	assert.NoError(t, exchange(udpEcho))
+	assert.Error(t, exchange(blockedEcho))
+}
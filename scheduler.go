@@ -0,0 +1,251 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: scheduler.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:18:22
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:26:59
+ */
+
+package socks5lb
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCheckInterval is the number of seconds between two checks of a backend
+	DefaultCheckInterval = 60
+	// DefaultCheckJitter is the share of the interval randomly added to or removed from it
+	DefaultCheckJitter = 0.1
+	// DefaultCheckWorkers is the number of health checks running at the same time
+	DefaultCheckWorkers = 8
+	// CheckStartSpread caps the random delay of the first check of a backend
+	CheckStartSpread = 5 * time.Second
+)
+
+// HealthCheckConfig controls how the backends are scheduled for their health checks
+type HealthCheckConfig struct {
+	Interval uint    `yaml:"interval"` // seconds between the checks of a backend, default CHECK_TIME_INTERVAL or 60
+	Jitter   float64 `yaml:"jitter"`   // share of the interval randomly added or removed, default 0.1
+	Workers  uint    `yaml:"workers"`  // concurrent health checks, default 8
+}
+
+// checkResult is the outcome of a health check run by a worker
+type checkResult struct {
+	backend *Backend
+	recheck bool
+}
+
+// CheckScheduler checks every backend of the pool on its own jittered interval with a bounded
+// number of workers, a backend changing its state is checked again right away
+type CheckScheduler struct {
+	pool     *Pool
+	interval time.Duration
+	jitter   float64
+	workers  int
+	exitIP   *ExitIPDiscovery
+	tick     time.Duration // resolution of the schedule
+	start    time.Duration // longest random delay of the first check of a backend
+
+	due     map[*Backend]time.Time
+	running map[*Backend]bool
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// intervalOf returns the check interval of the backend, its own one overrides the default
+func (c *CheckScheduler) intervalOf(backend *Backend) time.Duration {
+	if backend.CheckConfig.Interval > 0 {
+		return time.Duration(backend.CheckConfig.Interval) * time.Second
+	}
+	return c.interval
+}
+
+// jittered spreads the interval by the jitter so that the backends are not checked in lockstep
+func (c *CheckScheduler) jittered(interval time.Duration) time.Duration {
+	spread := time.Duration(c.jitter * float64(interval))
+	if spread <= 0 {
+		return interval
+	}
+	return interval - spread + rand.N(2*spread)
+}
+
+// schedule queues the backends which are due, the caller is the scheduling loop
+func (c *CheckScheduler) schedule(queue []*Backend) []*Backend {
+	now, seen := time.Now(), make(map[*Backend]bool)
+	for _, backend := range c.pool.All() {
+		seen[backend] = true
+		if c.running[backend] {
+			continue
+		}
+
+		// New backends are checked soon, spread over the jitter of their interval up to the start spread
+		due, ok := c.due[backend]
+		if !ok {
+			due = now
+			if spread := min(time.Duration(c.jitter*float64(c.intervalOf(backend))), c.start); spread > 0 {
+				due = now.Add(rand.N(spread))
+			}
+			c.due[backend] = due
+		}
+
+		if !now.Before(due) {
+			c.running[backend] = true
+			queue = append(queue, backend)
+		}
+	}
+
+	// Forget the backends removed from the pool
+	for backend := range c.due {
+		if !seen[backend] && !c.running[backend] {
+			delete(c.due, backend)
+		}
+	}
+
+	return queue
+}
+
+// work runs the health checks handed out by the scheduling loop
+func (c *CheckScheduler) work(jobs <-chan *Backend, results chan<- checkResult) {
+	for backend := range jobs {
+		changed, err := backend.check()
+		if err != nil {
+			log.Errorf("health check failed for backend %s: %v", backend.Addr, err)
+		} else {
+			log.Debugf("health check successful for backend %s", backend.Addr)
+		}
+
+		// The exit IP of healthy backends is discovered along with their checks
+		if c.exitIP.due(backend, changed) {
+			if err := c.exitIP.Discover(backend); err != nil {
+				log.Warnf("failed to discover the exit IP of backend %s: %v", backend.Addr, err)
+			}
+		}
+
+		select {
+		case results <- checkResult{backend: backend, recheck: changed}:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// CheckAll checks every backend of the pool once with the workers of the scheduler
+func (c *CheckScheduler) CheckAll() {
+	backends := c.pool.All()
+
+	jobs, results := make(chan *Backend), make(chan checkResult)
+	for i := 0; i < c.workers; i++ {
+		go c.work(jobs, results)
+	}
+	defer close(jobs)
+
+	go func() {
+		for _, backend := range backends {
+			jobs <- backend
+		}
+	}()
+
+	for range backends {
+		<-results
+	}
+}
+
+// run is the scheduling loop, it owns the schedule and feeds the workers
+func (c *CheckScheduler) run() {
+	defer c.done.Done()
+
+	jobs, results := make(chan *Backend), make(chan checkResult)
+	for i := 0; i < c.workers; i++ {
+		go c.work(jobs, results)
+	}
+	defer close(jobs)
+
+	ticker := time.NewTicker(c.tick)
+	defer ticker.Stop()
+
+	queue := c.schedule(nil)
+	for {
+		// Only offer a job while there is one queued
+		var send chan<- *Backend
+		var next *Backend
+		if len(queue) > 0 {
+			send, next = jobs, queue[0]
+		}
+
+		select {
+		case <-c.stop:
+			return
+
+		case send <- next:
+			queue = queue[1:]
+
+		case result := <-results:
+			delete(c.running, result.backend)
+			if result.recheck {
+				c.due[result.backend] = time.Now()
+			} else {
+				c.due[result.backend] = time.Now().Add(c.jittered(c.intervalOf(result.backend)))
+			}
+
+		case <-ticker.C:
+			queue = c.schedule(queue)
+		}
+	}
+}
+
+// Start runs the health checks in the background until Stop is called
+func (c *CheckScheduler) Start() {
+	log.Infof("starting automatic backend health checks every %v with %d workers", c.interval, c.workers)
+	c.done.Add(1)
+	go c.run()
+}
+
+// Stop ends the health checks, checks in flight finish in the background
+func (c *CheckScheduler) Stop() {
+	close(c.stop)
+	c.done.Wait()
+}
+
+// NewCheckScheduler creates a scheduler for the health checks of the pool, the exit IP of the
+// backends is discovered as well unless the discovery is nil
+func NewCheckScheduler(pool *Pool, config HealthCheckConfig, exitIP *ExitIPDiscovery) *CheckScheduler {
+	interval := time.Duration(config.Interval) * time.Second
+	if interval == 0 {
+		interval = SecFromEnv("CHECK_TIME_INTERVAL", DefaultCheckInterval)
+	}
+
+	jitter := config.Jitter
+	if jitter == 0 {
+		jitter = DefaultCheckJitter
+	}
+
+	workers := int(config.Workers)
+	if workers == 0 {
+		workers = DefaultCheckWorkers
+	}
+
+	return &CheckScheduler{
+		pool:     pool,
+		interval: interval,
+		jitter:   min(max(jitter, 0), 1),
+		workers:  workers,
+		exitIP:   exitIP,
+		tick:     time.Second,
+		start:    CheckStartSpread,
+		due:      make(map[*Backend]time.Time),
+		running:  make(map[*Backend]bool),
+		stop:     make(chan struct{}),
+	}
+}
@@ -0,0 +1,128 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: scheduler_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 10:18:22
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:26:59
+ */
+
+package socks5lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckScheduler_Jitter(t *testing.T) {
+	scheduler := NewCheckScheduler(newTestPool(), HealthCheckConfig{Interval: 60, Jitter: 0.2}, nil)
+	assert.Equal(t, 60*time.Second, scheduler.interval)
+	assert.Equal(t, DefaultCheckWorkers, scheduler.workers)
+
+	for i := 0; i < 100; i++ {
+		interval := scheduler.jittered(time.Minute)
+		assert.GreaterOrEqual(t, interval, 48*time.Second)
+		assert.Less(t, interval, 72*time.Second)
+	}
+
+	// Backends may override the interval
+	backend := NewBackend("127.0.0.1:1080", BackendCheckConfig{Interval: 5})
+	assert.Equal(t, 5*time.Second, scheduler.intervalOf(backend))
+	assert.Equal(t, time.Minute, scheduler.intervalOf(NewBackend("127.0.0.1:1081", BackendCheckConfig{})))
+}
+
+func TestCheckScheduler_Run(t *testing.T) {
+	var requests int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+	}))
+	t.Cleanup(target.Close)
+
+	var backends []*Backend
+	for i := 0; i < 3; i++ {
+		backends = append(backends, NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{
+			CheckURL: target.URL,
+			Timeout:  2,
+		}))
+	}
+
+	scheduler := NewCheckScheduler(newTestPool(backends...), HealthCheckConfig{Interval: 3600, Workers: 2}, nil)
+	scheduler.tick, scheduler.start = 10*time.Millisecond, 50*time.Millisecond
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	// Every backend is checked right away despite the long interval
+	assert.Eventually(t, func() bool {
+		for _, backend := range backends {
+			if !backend.Alive() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The state change of each backend is followed by another check, then they wait for the interval
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&requests) == 6 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(6), atomic.LoadInt64(&requests))
+}
+
+func TestCheckScheduler_FailedCheckWaitsForInterval(t *testing.T) {
+	var requests int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{
+		CheckURL: target.URL,
+		Timeout:  2,
+		Interval: 1,
+	})
+
+	scheduler := NewCheckScheduler(newTestPool(backend), HealthCheckConfig{Jitter: 0.01}, nil)
+	scheduler.tick, scheduler.start = 10*time.Millisecond, 10*time.Millisecond
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	// A single failure below the fall count is no state change, the next check waits for the interval
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&requests) == 3 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&requests))
+	assert.True(t, backend.Alive())
+}
+
+func TestCheckScheduler_CheckAll(t *testing.T) {
+	var requests int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+	}))
+	t.Cleanup(target.Close)
+
+	var backends []*Backend
+	for i := 0; i < 3; i++ {
+		backends = append(backends, NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{
+			CheckURL: target.URL,
+			Timeout:  2,
+		}))
+	}
+
+	// A single round checks every backend once
+	newTestPool(backends...).Check()
+	assert.Equal(t, int64(3), atomic.LoadInt64(&requests))
+	for _, backend := range backends {
+		assert.True(t, backend.Alive())
+	}
+}
@@ -9,25 +9,36 @@
  * File Created: Wednesday, July 6th 2022, 5:39:05 pm
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:22:20
+ * Last Modified: 2026-10-18 10:26:59
  */
 
 package socks5lb
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/txthinking/socks5"
 )
 
 const (
 	// BufferSize defines the size of buffers used for copying data between connections
 	BufferSize = 32 * 1024 // 32KB buffer for better performance
+
+	// DefaultMaxAttempts is the default number of backends tried for a single request
+	DefaultMaxAttempts = 3
 )
 
+// ErrNoHealthyBackend is returned when the pool has no backend left to try
+var ErrNoHealthyBackend = errors.New("no healthy backend available")
+
 var (
 	// bufferPool reuses buffers to reduce GC pressure
 	bufferPool = sync.Pool{
@@ -49,13 +60,27 @@ type Status struct {
 
 // Server represents the main SOCKS5 load balancer server
 type Server struct {
-	Pool   *Pool
-	Config *ServerConfig
+	Pool     *Pool
+	Config   *ServerConfig
+	Users    *UserStore
+	Sessions *SessionTable
+	Router   *Router
+	ExitIP   *ExitIPDiscovery
+
+	checks *CheckScheduler
+
+	socks5Listener    net.Listener
+	tproxyListener    net.Listener
+	socks4Listener    net.Listener
+	httpProxyListener net.Listener
+	mixedListener     net.Listener
 
-	healthCheckTimer *time.Ticker
+	httpTransport       *http.Transport
+	httpPinnedTransport *http.Transport
+	httpProxyOnce       sync.Once
 
-	socks5Listener net.Listener
-	tproxyListener net.Listener
+	// balancers of the listeners by their configuration key
+	balancers map[string]Balancer
 }
 
 // AddBackend adds a new backend to the server's pool
@@ -67,18 +92,14 @@ func (s *Server) AddBackend() error {
 // Start initializes and starts all server components
 // - Health check timer for periodic backend monitoring
 // - HTTP admin interface (if configured)
+// - SOCKS4/4a proxy listener (if configured)
+// - HTTP proxy listener (if configured)
+// - Mixed SOCKS5/SOCKS4/HTTP listener (if configured)
 // - SOCKS5 proxy listener
 func (s *Server) Start() (err error) {
-	duration := SecFromEnv("CHECK_TIME_INTERVAL", 60)
-
-	// Start periodic health check timer
-	s.healthCheckTimer = time.NewTicker(duration)
-	go func() {
-		log.Infof("starting automatic backend health checks every %v", duration)
-		for ; true; <-s.healthCheckTimer.C {
-			s.Pool.Check()
-		}
-	}()
+	// Start the health check scheduler
+	s.checks = NewCheckScheduler(s.Pool, s.Config.HealthCheck, s.ExitIP)
+	s.checks.Start()
 
 	//if s.Config.TProxy.Addr != "" {
 	//	log.Tracef("start tproxy address on %s", s.Config.TProxy.Addr)
@@ -99,15 +120,77 @@ func (s *Server) Start() (err error) {
 		}()
 	}
 
+	// Start SOCKS4 proxy in separate goroutine if configured
+	if s.Config.Socks4.Addr != "" {
+		log.Tracef("starting SOCKS4 proxy on %s", s.Config.Socks4.Addr)
+		go func() {
+			if err := s.ListenSocks4(s.Config.Socks4.Addr); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	// Start HTTP proxy in separate goroutine if configured
+	if s.Config.HTTPProxy.Addr != "" {
+		log.Tracef("starting HTTP proxy on %s", s.Config.HTTPProxy.Addr)
+		go func() {
+			if err := s.ListenHTTPProxy(s.Config.HTTPProxy.Addr); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	// Start mixed protocol listener in separate goroutine if configured
+	if s.Config.Mixed.Addr != "" {
+		log.Tracef("starting mixed proxy on %s", s.Config.Mixed.Addr)
+		go func() {
+			if err := s.ListenMixed(s.Config.Mixed.Addr); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
 	// Start SOCKS5 proxy server (blocks until error or shutdown)
 	log.Tracef("starting SOCKS5 proxy on %s", s.Config.Sock5.Addr)
 	return s.ListenSocks5(s.Config.Sock5.Addr)
 }
 
+// serve listens on the address and handles each connection in a separate goroutine
+func (s *Server) serve(name, addr string, listener *net.Listener, handler func(context.Context, net.Conn)) (err error) {
+	// Handlers pick backends with the balancer configured for the named listener
+	ctx := WithBalancer(context.Background(), s.balancers[name])
+
+	// The listener is kept so that Stop is able to close it
+	*listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer (*listener).Close()
+
+	for {
+		var conn net.Conn
+		conn, err = (*listener).Accept()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		// Handlers know the client for its IP hash and logging
+		go handler(WithClientAddr(ctx, conn.RemoteAddr()), conn)
+	}
+}
+
 // Stop gracefully shuts down the server and all listeners
 func (s *Server) Stop() (e error) {
 	log.Debug("initiating server shutdown")
-	s.healthCheckTimer.Stop()
+	if s.checks != nil {
+		s.checks.Stop()
+	}
+
+	if err := s.ExitIP.Close(); err != nil {
+		log.Warnf("failed to close the exit IP databases: %v", err)
+	}
 
 	// Close listeners asynchronously to avoid blocking
 	if s.socks5Listener != nil {
@@ -118,6 +201,159 @@ func (s *Server) Stop() (e error) {
 		go s.tproxyListener.Close()
 	}
 
+	if s.socks4Listener != nil {
+		go s.socks4Listener.Close()
+	}
+
+	if s.httpProxyListener != nil {
+		go s.httpProxyListener.Close()
+	}
+
+	if s.mixedListener != nil {
+		go s.mixedListener.Close()
+	}
+
+	return
+}
+
+// retryable reports whether a failed upstream connect is worth retrying on another backend,
+// replies telling the target itself refused the request would fail the same way everywhere
+func retryable(err error) bool {
+	var replyErr *Socks5ReplyError
+	if errors.As(err, &replyErr) {
+		switch replyErr.Rep {
+		case socks5.RepConnectionRefused, socks5.RepCommandNotSupported, socks5.RepAddressNotSupported:
+			return false
+		}
+	}
+
+	return true
+}
+
+// upstream runs the attempt with healthy backends, failing over to the next healthy
+// one when the attempt fails, up to the configured number of attempts
+func (s *Server) upstream(ctx context.Context, attempt func(backend *Backend, timeout int) error) (backend *Backend, err error) {
+	attempts := s.maxAttempts()
+	timeout := int(s.upstreamTimeout() / time.Second)
+
+	// Sessions stick to their backend, failing over re-pins them to the next one
+	balancer := BalancerFrom(ctx)
+	if SessionFrom(ctx) != "" {
+		balancer = s.Sessions.Balancer(balancer)
+	}
+
+	tried := make([]*Backend, 0, attempts)
+	for i := 0; i < attempts; {
+		if backend = s.Pool.Pick(ctx, balancer, tried...); backend == nil {
+			break
+		}
+		tried = append(tried, backend)
+
+		// Half-open backends only take a few trial connections at a time
+		if !backend.allow() {
+			continue
+		}
+		i++
+
+		err = attempt(backend, timeout)
+		s.reportAttempt(backend, err)
+		if err == nil {
+			return
+		}
+
+		log.Warnf("attempt %d via backend %s failed: %v", i, backend.Addr, err)
+		if !retryable(err) {
+			return nil, err
+		}
+	}
+
+	// Keep the last error, it explains the failure better than an empty pool
+	if err == nil {
+		err = ErrNoHealthyBackend
+	}
+
+	return nil, err
+}
+
+// directBackend stands for connections made without any backend
+var directBackend = &Backend{Addr: OutboundDirect, Weight: DefaultWeight}
+
+// upstreamTimeout returns the timeout of a single attempt to reach the target
+func (s *Server) upstreamTimeout() time.Duration {
+	if s.Config.Upstream.Timeout == 0 {
+		return DefaultDialTimeout
+	}
+	return time.Duration(s.Config.Upstream.Timeout) * time.Second
+}
+
+// maxAttempts returns the number of backends tried before giving up on the target
+func (s *Server) maxAttempts() int {
+	if s.Config.Upstream.MaxAttempts == 0 {
+		return DefaultMaxAttempts
+	}
+	return int(s.Config.Upstream.MaxAttempts)
+}
+
+// requestTimeout returns how long a client may wait for its request to be answered,
+// long enough for every attempt to run into its timeout before the reply is sent
+func (s *Server) requestTimeout() time.Duration {
+	return time.Duration(s.maxAttempts())*s.upstreamTimeout() + DefaultDialTimeout
+}
+
+// route matches the target against the routing rules, the returned context restricts the
+// backends to the group and exit of the route, rejected targets return ErrRejected
+func (s *Server) route(ctx context.Context, target string) (context.Context, Route, error) {
+	route := s.Router.Match(target)
+	if route.Index >= 0 {
+		log.Tracef("target %s matched rule %d (%s) with %s, routing to %s", target, route.Index, route.Rule, route.Matcher, route.Outbound)
+	}
+
+	switch route.Outbound {
+	case OutboundReject:
+		return ctx, route, fmt.Errorf("%s: %w", target, ErrRejected)
+	case OutboundDirect, "":
+	default:
+		ctx = WithGroup(ctx, route.Outbound)
+
+		// A group with its own strategy overrides the balancer of the listener
+		if balancer := s.Pool.GroupBalancer(route.Outbound); balancer != nil {
+			ctx = WithBalancer(ctx, balancer)
+		}
+	}
+
+	if !route.ExitFilter.Empty() {
+		ctx = WithExit(ctx, route.ExitFilter)
+	}
+
+	return ctx, route, nil
+}
+
+// dialUpstream connects to the target as the routing rules decide
+func (s *Server) dialUpstream(ctx context.Context, network, target string) (conn net.Conn, backend *Backend, err error) {
+	ctx, route, err := s.route(ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if route.Outbound == OutboundDirect {
+		dialer := net.Dialer{Timeout: s.upstreamTimeout()}
+		conn, err = dialer.DialContext(ctx, network, target)
+		return conn, directBackend, err
+	}
+
+	// The target host is the hash key unless the context carries one already
+	if HashKeyFrom(ctx) == "" {
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			ctx = WithHashKey(ctx, host)
+		}
+	}
+
+	// Fail over to the next healthy backend when connecting through one fails
+	backend, err = s.upstream(ctx, func(backend *Backend, timeout int) (err error) {
+		conn, err = backend.socks5Conn(ctx, network, target, timeout)
+		return
+	})
+
 	return
 }
 
@@ -161,8 +397,43 @@ func (s *Server) Transport(dst, src io.ReadWriter) (err error) {
 
 // NewServer creates a new Server instance with the given pool and configuration
 func NewServer(pool *Pool, config ServerConfig) (*Server, error) {
+	strategies := map[string]string{
+		"socks5":     config.Sock5.Strategy,
+		"socks4":     config.Socks4.Strategy,
+		"http_proxy": config.HTTPProxy.Strategy,
+		"mixed":      config.Mixed.Strategy,
+	}
+
+	balancers := make(map[string]Balancer, len(strategies))
+	for name, strategy := range strategies {
+		balancer, err := NewBalancer(strategy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		balancers[name] = balancer
+	}
+
+	sessions, err := NewSessionTable(config.Sessions.Pattern, time.Duration(config.Sessions.TTL)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := NewRouter(config.Rules.File)
+	if err != nil {
+		return nil, err
+	}
+
+	exitIP, err := NewExitIPDiscovery(config.ExitIP)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Server{
-		Pool:   pool,
-		Config: &config,
+		Pool:      pool,
+		Config:    &config,
+		Sessions:  sessions,
+		Router:    router,
+		ExitIP:    exitIP,
+		balancers: balancers,
 	}, nil
 }
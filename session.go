@@ -0,0 +1,259 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: session.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:59:19
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:59:19
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSessionTTL is how long a session stays pinned to its backend
+const DefaultSessionTTL = 10 * time.Minute
+
+type sessionKey struct{}
+
+// WithSession returns a context carrying the sticky session of the client
+func WithSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFrom returns the sticky session of the context, empty if there is none
+func SessionFrom(ctx context.Context) string {
+	session, _ := ctx.Value(sessionKey{}).(string)
+	return session
+}
+
+// Session describes a session pinned to a backend
+type Session struct {
+	Key       string    `json:"session"`
+	Backend   string    `json:"backend"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// sessionEntry is a pinned backend with the end of its pinning
+type sessionEntry struct {
+	backend *Backend
+	expires time.Time
+}
+
+// SessionTable pins sessions carried in client usernames to the backend they were first sent to
+type SessionTable struct {
+	pattern *regexp.Regexp
+	ttl     time.Duration
+
+	entries   map[string]*sessionEntry
+	lastPurge time.Time
+	lock      sync.Mutex
+}
+
+// Enabled reports whether usernames are parsed for sessions
+func (t *SessionTable) Enabled() bool {
+	return t != nil && t.pattern != nil
+}
+
+// Parse splits a username like "alice-session-abc123" into the account "alice" and the
+// session key "alice:abc123", the part matched by the pattern is removed from the username
+// and its first capture group, or the whole match, is the session id
+func (t *SessionTable) Parse(username string) (account, session string) {
+	if !t.Enabled() {
+		return username, ""
+	}
+
+	match := t.pattern.FindStringSubmatchIndex(username)
+	if match == nil {
+		return username, ""
+	}
+
+	id := username[match[0]:match[1]]
+	if len(match) >= 4 && match[2] >= 0 {
+		id = username[match[2]:match[3]]
+	}
+
+	account = username[:match[0]] + username[match[1]:]
+	if id == "" {
+		return account, ""
+	}
+
+	return account, account + ":" + id
+}
+
+// Lookup returns the backend the session is pinned to, nil if it is unknown or expired
+func (t *SessionTable) Lookup(session string) *Backend {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entry, ok := t.entries[session]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(t.entries, session)
+		return nil
+	}
+
+	return entry.backend
+}
+
+// Pin binds the session to the backend for the configured TTL
+func (t *SessionTable) Pin(session string, backend *Backend) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	// Drop expired sessions from time to time so the table does not grow forever
+	if now.Sub(t.lastPurge) > t.ttl {
+		for key, entry := range t.entries {
+			if now.After(entry.expires) {
+				delete(t.entries, key)
+			}
+		}
+		t.lastPurge = now
+	}
+
+	t.entries[session] = &sessionEntry{backend: backend, expires: now.Add(t.ttl)}
+}
+
+// All returns the sessions which are currently pinned, ordered by their key
+func (t *SessionTable) All() (sessions []Session) {
+	sessions = make([]Session, 0)
+	if !t.Enabled() {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for key, entry := range t.entries {
+		if now.After(entry.expires) {
+			continue
+		}
+
+		sessions = append(sessions, Session{
+			Key:       key,
+			Backend:   entry.backend.Addr,
+			ExpiresAt: entry.expires,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Key < sessions[j].Key
+	})
+
+	return
+}
+
+// Flush unpins the given session, or all of them if it is empty, returns the number of removed sessions
+func (t *SessionTable) Flush(session string) (count int) {
+	if !t.Enabled() {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if session == "" {
+		count = len(t.entries)
+		t.entries = make(map[string]*sessionEntry)
+		return
+	}
+
+	if _, ok := t.entries[session]; ok {
+		delete(t.entries, session)
+		count = 1
+	}
+
+	return
+}
+
+// sessionBalancer keeps a session on its pinned backend as long as it is a candidate,
+// otherwise the next balancer picks a backend which the session is pinned to from now on
+type sessionBalancer struct {
+	table *SessionTable
+	next  Balancer
+}
+
+func (b *sessionBalancer) Pick(ctx context.Context, candidates []*Backend) *Backend {
+	session := SessionFrom(ctx)
+	if session == "" {
+		return b.next.Pick(ctx, candidates)
+	}
+
+	if pinned := b.table.Lookup(session); pinned != nil && slices.Contains(candidates, pinned) {
+		return pinned
+	}
+
+	backend := b.next.Pick(ctx, candidates)
+	if backend != nil {
+		b.table.Pin(session, backend)
+	}
+
+	return backend
+}
+
+// Balancer wraps the balancer so that sessions stick to their backend, a nil balancer
+// lets new sessions land on a random backend
+func (t *SessionTable) Balancer(next Balancer) Balancer {
+	if next == nil {
+		next = RandomBalancer{}
+	}
+
+	if !t.Enabled() {
+		return next
+	}
+
+	return &sessionBalancer{table: t, next: next}
+}
+
+// authenticate checks the credentials of a client, the session carried in the username
+// is split off before the account is looked up in the user store
+func (s *Server) authenticate(username, password string) (account, session string, ok bool) {
+	account, session = s.Sessions.Parse(username)
+	if !s.Users.Authenticate(account, password) {
+		return "", "", false
+	}
+
+	return account, session, true
+}
+
+// NewSessionTable creates a session table parsing usernames with the pattern,
+// an empty pattern disables sticky sessions
+func NewSessionTable(pattern string, ttl time.Duration) (*SessionTable, error) {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	table := &SessionTable{
+		ttl:     ttl,
+		entries: make(map[string]*sessionEntry),
+	}
+
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session pattern: %w", err)
+		}
+		table.pattern = re
+	}
+
+	return table, nil
+}
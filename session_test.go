@@ -0,0 +1,144 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: session_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:59:19
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:59:19
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+func TestSessionTable_Parse(t *testing.T) {
+	table, err := NewSessionTable(`-session-([A-Za-z0-9]+)`, 0)
+	assert.NoError(t, err)
+	assert.True(t, table.Enabled())
+
+	account, session := table.Parse("alice-session-abc123")
+	assert.Equal(t, "alice", account)
+	assert.Equal(t, "alice:abc123", session)
+
+	account, session = table.Parse("alice")
+	assert.Equal(t, "alice", account)
+	assert.Empty(t, session)
+
+	// Without a pattern the username is left alone
+	disabled, err := NewSessionTable("", 0)
+	assert.NoError(t, err)
+	account, session = disabled.Parse("alice-session-abc123")
+	assert.Equal(t, "alice-session-abc123", account)
+	assert.Empty(t, session)
+
+	_, err = NewSessionTable("session-(", 0)
+	assert.Error(t, err)
+}
+
+func TestSessionTable_PinAndFlush(t *testing.T) {
+	table, err := NewSessionTable(`-session-(\w+)`, 50*time.Millisecond)
+	assert.NoError(t, err)
+
+	backends := newTestBackends(1, 1)
+	table.Pin("alice:a", backends[0])
+	table.Pin("alice:b", backends[1])
+
+	assert.Equal(t, backends[0], table.Lookup("alice:a"))
+	assert.Nil(t, table.Lookup("alice:c"))
+
+	sessions := table.All()
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "alice:a", sessions[0].Key)
+	assert.Equal(t, backends[0].Addr, sessions[0].Backend)
+
+	assert.Equal(t, 1, table.Flush("alice:a"))
+	assert.Equal(t, 0, table.Flush("alice:a"))
+	assert.Nil(t, table.Lookup("alice:a"))
+	assert.Equal(t, 1, table.Flush(""))
+	assert.Empty(t, table.All())
+
+	// Sessions are released after the TTL
+	table.Pin("alice:a", backends[0])
+	assert.Eventually(t, func() bool {
+		return table.Lookup("alice:a") == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionTable_Balancer(t *testing.T) {
+	table, err := NewSessionTable(`-session-(\w+)`, 0)
+	assert.NoError(t, err)
+
+	backends := newTestBackends(1, 1, 1)
+	pool := newTestPool(backends...)
+	balancer := table.Balancer(&RoundRobinBalancer{})
+
+	ctx := WithSession(context.Background(), "alice:a")
+	pinned := pool.Pick(ctx, balancer)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, pinned, pool.Pick(ctx, balancer))
+	}
+
+	// Other sessions are spread by the wrapped balancer
+	other := pool.Pick(WithSession(context.Background(), "alice:b"), balancer)
+	assert.NotEqual(t, pinned, other)
+
+	// A session of an unhealthy backend moves and sticks to its new backend
+	pinned.SetAlive(false)
+	moved := pool.Pick(ctx, balancer)
+	assert.NotEqual(t, pinned, moved)
+	pinned.SetAlive(true)
+	assert.Equal(t, moved, pool.Pick(ctx, balancer))
+	assert.Equal(t, moved, table.Lookup("alice:a"))
+}
+
+func TestServer_Socks5StickySession(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	var backends []*Backend
+	for i := 0; i < 3; i++ {
+		backends = append(backends, NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true}))
+	}
+
+	config := ServerConfig{}
+	config.Sessions.Pattern = `-session-(\w+)`
+	server, err := NewServer(newTestPool(backends...), config)
+	assert.NoError(t, err)
+	server.Users, _ = NewUserStore([]User{{Username: "alice", Password: "secret"}}, "")
+	addr := startTestListener(t, server.handleSocks5Connection)
+
+	dial := func(username string) {
+		client, err := socks5.NewClient(addr, username, "secret", 5, 5)
+		assert.NoError(t, err)
+
+		conn, err := client.Dial("tcp", echoAddr)
+		assert.NoError(t, err)
+		assertEcho(t, conn, username)
+		_ = conn.Close()
+	}
+
+	dial("alice-session-one")
+	pinned := server.Sessions.Lookup("alice:one")
+	assert.NotNil(t, pinned)
+
+	for i := 0; i < 5; i++ {
+		dial("alice-session-one")
+		assert.Equal(t, pinned, server.Sessions.Lookup("alice:one"))
+	}
+
+	// Plain usernames authenticate without creating sessions
+	dial("alice")
+	dial("alice-session-two")
+	assert.Len(t, server.Sessions.All(), 2)
+}
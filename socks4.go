@@ -0,0 +1,233 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: socks4.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:48:15
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:59:19
+ */
+
+package socks5lb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Socks4Version is the version byte of SOCKS4 requests
+	Socks4Version byte = 0x04
+	// Socks4CmdConnect is the SOCKS4 connect command
+	Socks4CmdConnect byte = 0x01
+
+	// Socks4RepGranted means the request is granted
+	Socks4RepGranted byte = 0x5A
+	// Socks4RepRejected means the request is rejected or failed
+	Socks4RepRejected byte = 0x5B
+	// Socks4RepUserMismatch means the user-id could not be verified
+	Socks4RepUserMismatch byte = 0x5D
+
+	// maxSocks4FieldLength limits the null-terminated fields of a request
+	maxSocks4FieldLength = 255
+)
+
+// socks4Request is a parsed SOCKS4 or SOCKS4a request
+type socks4Request struct {
+	Cmd    byte
+	Port   uint16
+	IP     net.IP
+	UserID string
+	Domain string // SOCKS4a target host, the IP is 0.0.0.x then
+}
+
+// Address returns the target of the request like host:port
+func (r *socks4Request) Address() string {
+	host := r.IP.String()
+	if r.Domain != "" {
+		host = r.Domain
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+}
+
+// isSocks4a reports whether the IP marks a SOCKS4a request, that is 0.0.0.x with x non-zero
+func isSocks4a(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 0 && ip4[1] == 0 && ip4[2] == 0 && ip4[3] != 0
+}
+
+// readSocks4String reads a null-terminated field of a SOCKS4 request
+func readSocks4String(reader *bufio.Reader) (string, error) {
+	var field []byte
+	for len(field) <= maxSocks4FieldLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		field = append(field, b)
+	}
+
+	return "", errors.New("SOCKS4 field is too long")
+}
+
+// newSocks4RequestFrom reads a SOCKS4 request from the client
+func newSocks4RequestFrom(reader *bufio.Reader) (req *socks4Request, err error) {
+	head := make([]byte, 8)
+	if _, err = io.ReadFull(reader, head); err != nil {
+		return
+	}
+
+	if head[0] != Socks4Version {
+		return nil, errors.New("invalid SOCKS4 version")
+	}
+
+	req = &socks4Request{
+		Cmd:  head[1],
+		Port: binary.BigEndian.Uint16(head[2:4]),
+		IP:   net.IP(head[4:8]),
+	}
+
+	if req.UserID, err = readSocks4String(reader); err != nil {
+		return nil, err
+	}
+
+	// SOCKS4a appends the domain name to resolve by the proxy
+	if isSocks4a(req.IP) {
+		if req.Domain, err = readSocks4String(reader); err != nil {
+			return nil, err
+		}
+		if req.Domain == "" {
+			return nil, errors.New("empty SOCKS4a domain")
+		}
+	}
+
+	return
+}
+
+// socks4Authenticate maps the user-id onto the user store, it has to carry the
+// credentials as "username:password" since SOCKS4 has no password field,
+// returns the authenticated username or whether the client is rejected
+func (s *Server) socks4Authenticate(userID string) (username, session string, ok bool) {
+	if !s.Users.Enabled() {
+		return "", "", true
+	}
+
+	username, password, found := strings.Cut(userID, ":")
+	if !found {
+		return "", "", false
+	}
+
+	return s.authenticate(username, password)
+}
+
+// socks4Reply writes a reply with the given code to the client
+func socks4Reply(w io.Writer, rep byte) (err error) {
+	_, err = w.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return
+}
+
+// ListenSocks4 listens on a specific address and handles SOCKS4 and SOCKS4a connections
+func (s *Server) ListenSocks4(addr string) (err error) {
+	return s.serve("socks4", addr, &s.socks4Listener, s.handleSocks4Connection)
+}
+
+// handleSocks4Connection processes a single SOCKS4 or SOCKS4a client connection
+func (s *Server) handleSocks4Connection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Enable TCP keepalive to detect dead connections
+	setKeepAlive(conn)
+
+	// Limit the time a client may spend on the handshake
+	if err := conn.SetDeadline(time.Now().Add(DefaultDialTimeout)); err != nil {
+		log.Warnf("failed to set handshake deadline: %v", err)
+	}
+
+	// Connections from the mixed listener are buffered already
+	buffered, ok := conn.(*bufferedConn)
+	if !ok {
+		buffered = &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	}
+
+	req, err := newSocks4RequestFrom(buffered.reader)
+	if err != nil {
+		log.Errorf("failed to read SOCKS4 request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	username, session, ok := s.socks4Authenticate(req.UserID)
+	if !ok {
+		log.Warnf("SOCKS4 authentication failed for %s", conn.RemoteAddr())
+		_ = socks4Reply(conn, Socks4RepUserMismatch)
+		return
+	}
+
+	if username != "" {
+		log.Tracef("client %s authenticated as %s", conn.RemoteAddr(), username)
+	}
+
+	if session != "" {
+		ctx = WithSession(ctx, session)
+	}
+
+	if req.Cmd != Socks4CmdConnect {
+		log.Warnf("unsupported SOCKS4 command %#02x from %s", req.Cmd, conn.RemoteAddr())
+		_ = socks4Reply(conn, Socks4RepRejected)
+		return
+	}
+
+	// Connecting upstream may fail over several backends, give the reply enough time
+	if err := conn.SetDeadline(time.Now().Add(s.requestTimeout())); err != nil {
+		log.Warnf("failed to extend handshake deadline: %v", err)
+	}
+
+	// The target is requested from the backend with SOCKS5, domains are resolved there
+	target := req.Address()
+	backendConn, backend, err := s.dialUpstream(ctx, "tcp", target)
+	if err != nil {
+		log.Errorf("failed to connect %s: %v", target, err)
+		_ = socks4Reply(conn, Socks4RepRejected)
+		return
+	}
+	defer backendConn.Close()
+
+	// Enable TCP keepalive on backend connection
+	setKeepAlive(backendConn)
+
+	if err := socks4Reply(conn, Socks4RepGranted); err != nil {
+		log.Errorf("failed to reply to %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Handshake is done, clear the deadline for the data stream
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Warnf("failed to clear handshake deadline: %v", err)
+	}
+
+	log.Tracef("relaying %s -> %s via backend %s", conn.RemoteAddr(), target, backend.Addr)
+
+	backend.acquire()
+	defer backend.release()
+
+	// Transport data bidirectionally between client and backend
+	if err := s.Transport(buffered, backendConn); err != nil {
+		log.Debugf("transport error: %v", err)
+	}
+}
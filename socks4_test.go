@@ -0,0 +1,111 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: socks4_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:48:54
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:48:54
+ */
+
+package socks5lb
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// socks4Connect sends a SOCKS4 CONNECT request and returns the reply code, a non-empty
+// domain turns it into a SOCKS4a request with the port of the target
+func socks4Connect(t *testing.T, conn net.Conn, target, userID, domain string) byte {
+	host, portStr, err := net.SplitHostPort(target)
+	assert.NoError(t, err)
+	port, _ := strconv.Atoi(portStr)
+
+	ip := net.ParseIP(host).To4()
+	if domain != "" {
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+
+	req := []byte{Socks4Version, Socks4CmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	req = append(req, ip...)
+	req = append(req, []byte(userID)...)
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, []byte(domain)...)
+		req = append(req, 0)
+	}
+
+	_, err = conn.Write(req)
+	assert.NoError(t, err)
+
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+
+	return reply[1]
+}
+
+// startSocks4Server serves SOCKS4 clients with the given pool on a random local port
+func startSocks4Server(t *testing.T, pool *Pool) (*Server, string) {
+	server, err := NewServer(pool, ServerConfig{})
+	assert.NoError(t, err)
+
+	return server, startTestListener(t, server.handleSocks4Connection)
+}
+
+func TestServer_Socks4Connect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	_, addr := startSocks4Server(t, newTestPool(backend))
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, Socks4RepGranted, socks4Connect(t, conn, echoAddr, "anyone", ""))
+	assertEcho(t, conn, "socks4")
+}
+
+func TestServer_Socks4aConnect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	_, addr := startSocks4Server(t, newTestPool(backend))
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// The domain is handed to the backend, which resolves it
+	assert.Equal(t, Socks4RepGranted, socks4Connect(t, conn, echoAddr, "", "localhost"))
+	assertEcho(t, conn, "socks4a")
+}
+
+func TestServer_Socks4Authentication(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	server, addr := startSocks4Server(t, newTestPool(backend))
+	server.Users, _ = NewUserStore([]User{{Username: "alice", Password: "secret"}}, "")
+
+	for userID, expected := range map[string]byte{
+		"":             Socks4RepUserMismatch,
+		"alice":        Socks4RepUserMismatch,
+		"alice:wrong":  Socks4RepUserMismatch,
+		"alice:secret": Socks4RepGranted,
+	} {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, socks4Connect(t, conn, echoAddr, userID, ""), userID)
+		_ = conn.Close()
+	}
+}
@@ -9,16 +9,22 @@
  * File Created: Wednesday, July 6th 2022, 11:46:39 am
  *
  * Modified By: mingcheng (mingcheng@apache.org)
- * Last Modified: 2025-10-07 11:21:47
+ * Last Modified: 2026-10-18 10:01:31
  */
 
 package socks5lb
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/txthinking/socks5"
 )
 
 const (
@@ -26,76 +32,277 @@ const (
 	DefaultDialTimeout = 10 * time.Second
 	// DefaultKeepAlivePeriod is the interval for TCP keepalive probes
 	DefaultKeepAlivePeriod = 30 * time.Second
+	// DefaultBindTimeout is how long a BIND waits for the incoming connection
+	DefaultBindTimeout = 2 * time.Minute
 )
 
 // ListenSocks5 listens on a specific address and handles SOCKS5 connections
 func (s *Server) ListenSocks5(addr string) (err error) {
-	s.socks5Listener, err = net.Listen("tcp", addr)
+	return s.serve("socks5", addr, &s.socks5Listener, s.handleSocks5Connection)
+}
+
+// setKeepAlive enables TCP keepalive on the connection to detect dead peers
+func setKeepAlive(conn net.Conn) {
+	// Connections through a backend and the ones of the mixed listener wrap the TCP connection
+	switch wrapped := conn.(type) {
+	case *socks5.Client:
+		if wrapped.TCPConn != nil {
+			conn = wrapped.TCPConn
+		}
+	case *bufferedConn:
+		conn = wrapped.Conn
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			log.Warnf("failed to set keepalive: %v", err)
+		}
+		if err := tcpConn.SetKeepAlivePeriod(DefaultKeepAlivePeriod); err != nil {
+			log.Warnf("failed to set keepalive period: %v", err)
+		}
+	}
+}
+
+// socks5Reply writes a reply with the given code and bound address to the client
+func socks5Reply(w io.Writer, rep byte, addr net.Addr) (err error) {
+	atyp, host, port := socks5.ATYPIPv4, []byte{0, 0, 0, 0}, []byte{0, 0}
+	if addr != nil {
+		if a, h, p, err := socks5.ParseAddress(addr.String()); err == nil {
+			atyp, host, port = a, h, p
+		}
+	}
+
+	// NewReply prepends the domain length by itself
+	if atyp == socks5.ATYPDomain {
+		host = host[1:]
+	}
+
+	_, err = socks5.NewReply(rep, atyp, host, port).WriteTo(w)
+	return
+}
+
+// socks5ReplyCode maps an upstream error to the reply code sent back to the client
+func socks5ReplyCode(err error) byte {
+	if errors.Is(err, ErrRejected) {
+		return socks5.RepNotAllowed
+	}
+
+	var replyErr *Socks5ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Rep
+	}
+
+	return socks5.RepServerFailure
+}
+
+// socks5Negotiate reads the client greeting and selects the authentication method,
+// returns the authenticated username and its sticky session when the user store is enabled
+func (s *Server) socks5Negotiate(conn net.Conn) (username, session string, err error) {
+	req, err := socks5.NewNegotiationRequestFrom(conn)
 	if err != nil {
-		log.Error(err)
 		return
 	}
-	defer s.socks5Listener.Close()
 
-	for {
-		var socks5Conn net.Conn
-		socks5Conn, err = s.socks5Listener.Accept()
-		if err != nil {
-			log.Error(err)
-			return
-		}
+	method := socks5.MethodNone
+	if s.Users.Enabled() {
+		method = socks5.MethodUsernamePassword
+	}
+
+	if !bytes.Contains(req.Methods, []byte{method}) {
+		_, _ = socks5.NewNegotiationReply(socks5.MethodUnsupportAll).WriteTo(conn)
+		return "", "", fmt.Errorf("no acceptable authentication methods in %v", req.Methods)
+	}
+
+	if _, err = socks5.NewNegotiationReply(method).WriteTo(conn); err != nil || method == socks5.MethodNone {
+		return
+	}
+
+	// RFC 1929 username/password authentication
+	auth, err := socks5.NewUserPassNegotiationRequestFrom(conn)
+	if err != nil {
+		return
+	}
 
-		// Handle each connection in a separate goroutine
-		go s.handleSocks5Connection(socks5Conn)
+	username, session, ok := s.authenticate(string(auth.Uname), string(auth.Passwd))
+	if !ok {
+		_, _ = socks5.NewUserPassNegotiationReply(socks5.UserPassStatusFailure).WriteTo(conn)
+		return "", "", fmt.Errorf("authentication failed for user %q", auth.Uname)
 	}
+
+	if _, err = socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess).WriteTo(conn); err != nil {
+		return "", "", err
+	}
+
+	return username, session, nil
 }
 
 // handleSocks5Connection processes a single SOCKS5 client connection
-func (s *Server) handleSocks5Connection(socks5Conn net.Conn) {
+func (s *Server) handleSocks5Connection(ctx context.Context, socks5Conn net.Conn) {
 	defer socks5Conn.Close()
 
 	// Enable TCP keepalive to detect dead connections
-	if tcpConn, ok := socks5Conn.(*net.TCPConn); ok {
-		if err := tcpConn.SetKeepAlive(true); err != nil {
-			log.Warnf("failed to set keepalive: %v", err)
-		}
-		if err := tcpConn.SetKeepAlivePeriod(DefaultKeepAlivePeriod); err != nil {
-			log.Warnf("failed to set keepalive period: %v", err)
-		}
+	setKeepAlive(socks5Conn)
+
+	// Limit the time a client may spend on the handshake
+	if err := socks5Conn.SetDeadline(time.Now().Add(DefaultDialTimeout)); err != nil {
+		log.Warnf("failed to set handshake deadline: %v", err)
+	}
+
+	username, session, err := s.socks5Negotiate(socks5Conn)
+	if err != nil {
+		log.Errorf("SOCKS5 negotiation with %s failed: %v", socks5Conn.RemoteAddr(), err)
+		return
+	}
+
+	if username != "" {
+		log.Tracef("client %s authenticated as %s", socks5Conn.RemoteAddr(), username)
+	}
+
+	if session != "" {
+		ctx = WithSession(ctx, session)
 	}
 
-	// Select a healthy backend from the pool
-	backend := s.Pool.Next()
-	if backend == nil {
-		log.Error("no healthy backend available, closing connection")
+	req, err := socks5.NewRequestFrom(socks5Conn)
+	if err != nil {
+		log.Errorf("failed to read SOCKS5 request from %s: %v", socks5Conn.RemoteAddr(), err)
+		if errors.Is(err, socks5.ErrBadRequest) {
+			_ = socks5Reply(socks5Conn, socks5.RepAddressNotSupported, nil)
+		}
 		return
 	}
 
-	// Dial the backend with timeout
-	dialer := net.Dialer{
-		Timeout:   DefaultDialTimeout,
-		KeepAlive: DefaultKeepAlivePeriod,
+	// Connecting upstream may fail over several backends, give the reply enough time
+	if err := socks5Conn.SetDeadline(time.Now().Add(s.requestTimeout())); err != nil {
+		log.Warnf("failed to extend handshake deadline: %v", err)
 	}
 
-	backendConn, err := dialer.Dial("tcp", string(backend.Addr))
+	switch req.Cmd {
+	case socks5.CmdConnect:
+		s.handleSocks5Connect(ctx, socks5Conn, req)
+	case socks5.CmdBind:
+		s.handleSocks5Bind(ctx, socks5Conn, req)
+	case socks5.CmdUDP:
+		s.handleSocks5Associate(ctx, socks5Conn, req)
+	default:
+		log.Warnf("unsupported SOCKS5 command %#02x from %s", req.Cmd, socks5Conn.RemoteAddr())
+		_ = socks5Reply(socks5Conn, socks5.RepCommandNotSupported, nil)
+	}
+}
+
+// handleSocks5Connect serves the CONNECT command by opening the upstream leg through a backend
+func (s *Server) handleSocks5Connect(ctx context.Context, socks5Conn net.Conn, req *socks5.Request) {
+	target := req.Address()
+
+	// Connect to the target through a healthy backend with its own credentials
+	backendConn, backend, err := s.dialUpstream(ctx, "tcp", target)
 	if err != nil {
-		log.Errorf("failed to dial backend %s: %v", backend.Addr, err)
+		log.Errorf("failed to connect %s: %v", target, err)
+		_ = socks5Reply(socks5Conn, socks5ReplyCode(err), nil)
 		return
 	}
 	defer backendConn.Close()
 
 	// Enable TCP keepalive on backend connection
-	if tcpConn, ok := backendConn.(*net.TCPConn); ok {
-		if err := tcpConn.SetKeepAlive(true); err != nil {
-			log.Warnf("failed to set backend keepalive: %v", err)
-		}
-		if err := tcpConn.SetKeepAlivePeriod(DefaultKeepAlivePeriod); err != nil {
-			log.Warnf("failed to set backend keepalive period: %v", err)
-		}
+	setKeepAlive(backendConn)
+
+	if err := socks5Reply(socks5Conn, socks5.RepSuccess, backendConn.LocalAddr()); err != nil {
+		log.Errorf("failed to reply to %s: %v", socks5Conn.RemoteAddr(), err)
+		return
+	}
+
+	// Handshake is done, clear the deadline for the data stream
+	if err := socks5Conn.SetDeadline(time.Time{}); err != nil {
+		log.Warnf("failed to clear handshake deadline: %v", err)
 	}
 
+	log.Tracef("relaying %s -> %s via backend %s", socks5Conn.RemoteAddr(), target, backend.Addr)
+
+	backend.acquire()
+	defer backend.release()
+
 	// Transport data bidirectionally between client and backend
 	if err := s.Transport(socks5Conn, backendConn); err != nil {
 		log.Debugf("transport error: %v", err)
 	}
 }
+
+// handleSocks5Bind serves the BIND command by forwarding it to a backend, both the reply
+// with the listening address and the one announcing the incoming connection are relayed
+func (s *Server) handleSocks5Bind(ctx context.Context, socks5Conn net.Conn, req *socks5.Request) {
+	target := req.Address()
+
+	// Only a backend can listen for the target, DIRECT rules fall back to the backends
+	ctx, _, err := s.route(ctx, target)
+	if err != nil {
+		log.Errorf("failed to bind for %s: %v", target, err)
+		_ = socks5Reply(socks5Conn, socks5ReplyCode(err), nil)
+		return
+	}
+
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		ctx = WithHashKey(ctx, host)
+	}
+
+	var (
+		backendConn net.Conn
+		bound       net.Addr
+	)
+
+	backend, err := s.upstream(ctx, func(backend *Backend, timeout int) (err error) {
+		backendConn, bound, err = backend.Socks5Bind(target, timeout)
+		return
+	})
+	if err != nil {
+		log.Errorf("failed to bind for %s: %v", target, err)
+		_ = socks5Reply(socks5Conn, socks5ReplyCode(err), nil)
+		return
+	}
+	defer backendConn.Close()
+
+	// First reply tells the client where the backend listens for the target
+	if err := socks5Reply(socks5Conn, socks5.RepSuccess, bound); err != nil {
+		log.Errorf("failed to reply to %s: %v", socks5Conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Tracef("backend %s is listening on %s for %s", backend.Addr, bound, target)
+
+	// The incoming connection may take longer than the handshake deadline allows
+	if err := socks5Conn.SetDeadline(time.Time{}); err != nil {
+		log.Warnf("failed to clear handshake deadline: %v", err)
+	}
+
+	// Second reply arrives once the target connected to the backend
+	if err := backendConn.SetReadDeadline(time.Now().Add(DefaultBindTimeout)); err != nil {
+		log.Warnf("failed to set bind deadline: %v", err)
+	}
+
+	reply, err := socks5.NewReplyFrom(backendConn)
+	if err != nil {
+		log.Errorf("failed to receive incoming connection for %s: %v", target, err)
+		_ = socks5Reply(socks5Conn, socks5.RepTTLExpired, nil)
+		return
+	}
+
+	if err := socks5Reply(socks5Conn, reply.Rep, socks5Addr{network: "tcp", addr: reply.Address()}); err != nil {
+		log.Errorf("failed to reply to %s: %v", socks5Conn.RemoteAddr(), err)
+		return
+	}
+
+	if reply.Rep != socks5.RepSuccess {
+		log.Errorf("backend %s failed to accept connection for %s with code %#02x", backend.Addr, target, reply.Rep)
+		return
+	}
+
+	// Both sides are connected, clear the deadline for the data stream
+	if err := backendConn.SetDeadline(time.Time{}); err != nil {
+		log.Warnf("failed to clear bind deadline: %v", err)
+	}
+
+	backend.acquire()
+	defer backend.release()
+
+	if err := s.Transport(socks5Conn, backendConn); err != nil {
+		log.Debugf("transport error: %v", err)
+	}
+}
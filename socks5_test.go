@@ -0,0 +1,481 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: socks5_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:35:02
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:01:31
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+// freeAddr returns a local address with a port that is currently unused
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// startEchoServer starts a TCP server echoing everything back to the client
+func startEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// startSocks5Backend starts an upstream SOCKS5 server, requiring credentials when given,
+// the listeners are opened here as ListenAndServe assigns them racing with Shutdown
+func startSocks5Backend(t *testing.T, username, password string) string {
+	server, err := socks5.NewClassicServer(freeAddr(t), "127.0.0.1", username, password, 0, 0)
+	assert.NoError(t, err)
+	server.Handle = &socks5.DefaultHandle{}
+
+	server.TCPListen, err = net.ListenTCP("tcp", server.TCPAddr)
+	assert.NoError(t, err)
+	server.UDPConn, err = net.ListenUDP("udp", server.UDPAddr)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = server.TCPListen.Close()
+		_ = server.UDPConn.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := server.TCPListen.AcceptTCP()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if err := server.Negotiate(conn); err != nil {
+					return
+				}
+				if request, err := server.GetRequest(conn); err == nil {
+					_ = server.Handle.TCPHandle(server, conn, request)
+				}
+			}()
+		}
+	}()
+
+	go func() {
+		for {
+			buf := make([]byte, MaxUDPPacketSize)
+			n, addr, err := server.UDPConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if datagram, err := socks5.NewDatagramFromBytes(buf[:n]); err == nil && datagram.Frag == 0 {
+				go func() { _ = server.Handle.UDPHandle(server, addr, datagram) }()
+			}
+		}
+	}()
+
+	return server.TCPAddr.String()
+}
+
+// startHangingBackend starts a backend accepting connections without ever answering them
+func startHangingBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	var lock sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		_ = l.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// newTestPool creates a standalone pool, the shared one from NewPool is a singleton
+func newTestPool(backends ...*Backend) *Pool {
+	pool := &Pool{
+		backends: make(map[string]*Backend),
+	}
+
+	for _, b := range backends {
+		_ = pool.Add(b)
+	}
+
+	return pool
+}
+
+// startTestListener serves every accepted connection with the handler on a random local port
+func startTestListener(t *testing.T, handler func(context.Context, net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handler(WithClientAddr(context.Background(), conn.RemoteAddr()), conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// startTestServer serves SOCKS5 clients with the given pool on a random local port
+func startTestServer(t *testing.T, pool *Pool) (*Server, string) {
+	server, err := NewServer(pool, ServerConfig{})
+	assert.NoError(t, err)
+
+	return server, startTestListener(t, server.handleSocks5Connection)
+}
+
+// assertEcho writes a message through the connection and expects it back
+func assertEcho(t *testing.T, conn net.Conn, message string) {
+	_, err := conn.Write([]byte(message))
+	assert.NoError(t, err)
+
+	buf := make([]byte, len(message))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, message, string(buf))
+}
+
+func TestServer_Socks5Connect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	// The backend requires credentials which the client never knows about
+	backend := NewBackend(startSocks5Backend(t, "backend", "secret"), BackendCheckConfig{InitialAlive: true})
+	backend.UserName, backend.Password = "backend", "secret"
+
+	_, addr := startTestServer(t, newTestPool(backend))
+
+	client, err := socks5.NewClient(addr, "", "", 5, 5)
+	assert.NoError(t, err)
+
+	conn, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assertEcho(t, conn, "hello, socks5lb")
+	assert.Equal(t, int64(1), backend.ActiveConns())
+	assert.Positive(t, backend.Latency())
+
+	// The counter drops once the tunnel is torn down
+	_ = conn.Close()
+	assert.Eventually(t, func() bool {
+		return backend.ActiveConns() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_Socks5WrongBackendCredentials(t *testing.T) {
+	backend := NewBackend(startSocks5Backend(t, "backend", "secret"), BackendCheckConfig{InitialAlive: true})
+	backend.UserName, backend.Password = "backend", "wrong"
+
+	_, addr := startTestServer(t, newTestPool(backend))
+
+	client, err := socks5.NewClient(addr, "", "", 5, 5)
+	assert.NoError(t, err)
+
+	_, err = client.Dial("tcp", startEchoServer(t))
+	assert.Error(t, err)
+}
+
+func TestServer_Socks5NoHealthyBackend(t *testing.T) {
+	_, addr := startTestServer(t, newTestPool())
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = socks5.NewNegotiationRequest([]byte{socks5.MethodNone}).WriteTo(conn)
+	assert.NoError(t, err)
+
+	negotiation, err := socks5.NewNegotiationReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.MethodNone, negotiation.Method)
+
+	_, err = socks5.NewRequest(socks5.CmdConnect, socks5.ATYPIPv4, []byte{127, 0, 0, 1}, []byte{0, 80}).WriteTo(conn)
+	assert.NoError(t, err)
+
+	reply, err := socks5.NewReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.RepServerFailure, reply.Rep)
+}
+
+func TestServer_Socks5UnsupportedMethod(t *testing.T) {
+	_, addr := startTestServer(t, newTestPool())
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = socks5.NewNegotiationRequest([]byte{socks5.MethodGSSAPI}).WriteTo(conn)
+	assert.NoError(t, err)
+
+	negotiation, err := socks5.NewNegotiationReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.MethodUnsupportAll, negotiation.Method)
+}
+
+func TestServer_Socks5Failover(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	// Nothing is listening on the dead backend, every connect to it fails
+	dead := NewBackend(freeAddr(t), BackendCheckConfig{InitialAlive: true})
+	alive := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	server, addr := startTestServer(t, newTestPool(dead, alive))
+	server.Config.Upstream.MaxAttempts = 2
+
+	for i := 0; i < 4; i++ {
+		client, err := socks5.NewClient(addr, "", "", 5, 5)
+		assert.NoError(t, err)
+
+		conn, err := client.Dial("tcp", echoAddr)
+		assert.NoError(t, err)
+		assertEcho(t, conn, "failover")
+		_ = conn.Close()
+	}
+}
+
+func TestServer_Socks5FailoverTimeout(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	// Backends take turns, one of the connections tries the hanging backend first
+	// and the attempt through it runs into the timeout
+	hanging := NewBackend(startHangingBackend(t), BackendCheckConfig{InitialAlive: true})
+	alive := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	server, addr := startTestServer(t, newTestPool(hanging, alive))
+	server.Config.Upstream.MaxAttempts = 2
+
+	// The client still gets its reply after the failover took longer than the handshake timeout
+	for i := 0; i < 2; i++ {
+		client, err := socks5.NewClient(addr, "", "", 30, 30)
+		assert.NoError(t, err)
+
+		conn, err := client.Dial("tcp", echoAddr)
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "failover")
+			_ = conn.Close()
+		}
+	}
+}
+
+func TestServer_Socks5FailoverExhausted(t *testing.T) {
+	server, addr := startTestServer(t, newTestPool(
+		NewBackend(freeAddr(t), BackendCheckConfig{InitialAlive: true}),
+		NewBackend(freeAddr(t), BackendCheckConfig{InitialAlive: true}),
+		NewBackend(freeAddr(t), BackendCheckConfig{InitialAlive: true}),
+	))
+	server.Config.Upstream.MaxAttempts = 5
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = socks5.NewNegotiationRequest([]byte{socks5.MethodNone}).WriteTo(conn)
+	assert.NoError(t, err)
+	_, err = socks5.NewNegotiationReplyFrom(conn)
+	assert.NoError(t, err)
+
+	_, err = socks5.NewRequest(socks5.CmdConnect, socks5.ATYPIPv4, []byte{127, 0, 0, 1}, []byte{0, 80}).WriteTo(conn)
+	assert.NoError(t, err)
+
+	// Every backend is tried once before the failure is reported
+	reply, err := socks5.NewReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.RepServerFailure, reply.Rep)
+}
+
+func TestServer_Socks5Authentication(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	server, addr := startTestServer(t, newTestPool(backend))
+	server.Users, _ = NewUserStore([]User{{Username: "alice", Password: "secret"}}, "")
+
+	client, err := socks5.NewClient(addr, "alice", "secret", 5, 5)
+	assert.NoError(t, err)
+
+	conn, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	assertEcho(t, conn, "authenticated")
+	_ = conn.Close()
+
+	// Wrong password is rejected with a failure status
+	client, _ = socks5.NewClient(addr, "alice", "wrong", 5, 5)
+	_, err = client.Dial("tcp", echoAddr)
+	assert.ErrorIs(t, err, socks5.ErrUserPassAuth)
+
+	// Unauthenticated clients get no acceptable method
+	client, _ = socks5.NewClient(addr, "", "", 5, 5)
+	_, err = client.Dial("tcp", echoAddr)
+	assert.Error(t, err)
+}
+
+// startBindBackend starts an upstream SOCKS5 server only serving BIND, the accepted
+// connection is echoed back to the peer through the client of the backend
+func startBindBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if _, err := socks5.NewNegotiationRequestFrom(conn); err != nil {
+					return
+				}
+				_, _ = socks5.NewNegotiationReply(socks5.MethodNone).WriteTo(conn)
+
+				if _, err := socks5.NewRequestFrom(conn); err != nil {
+					return
+				}
+
+				incoming, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				defer incoming.Close()
+
+				_ = socks5Reply(conn, socks5.RepSuccess, incoming.Addr())
+				peer, err := incoming.Accept()
+				if err != nil {
+					return
+				}
+				defer peer.Close()
+
+				_ = socks5Reply(conn, socks5.RepSuccess, peer.RemoteAddr())
+				go func() { _, _ = io.Copy(conn, peer) }()
+				_, _ = io.Copy(peer, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// socks5Handshake negotiates without authentication and sends the request
+func socks5Handshake(t *testing.T, conn net.Conn, cmd byte, addr string) {
+	_, err := socks5.NewNegotiationRequest([]byte{socks5.MethodNone}).WriteTo(conn)
+	assert.NoError(t, err)
+	_, err = socks5.NewNegotiationReplyFrom(conn)
+	assert.NoError(t, err)
+
+	atyp, host, port, err := socks5.ParseAddress(addr)
+	assert.NoError(t, err)
+	if atyp == socks5.ATYPDomain {
+		host = host[1:]
+	}
+	_, err = socks5.NewRequest(cmd, atyp, host, port).WriteTo(conn)
+	assert.NoError(t, err)
+}
+
+func TestServer_Socks5Bind(t *testing.T) {
+	backend := NewBackend(startBindBackend(t), BackendCheckConfig{InitialAlive: true})
+	_, addr := startTestServer(t, newTestPool(backend))
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	socks5Handshake(t, conn, socks5.CmdBind, "127.0.0.1:21")
+
+	first, err := socks5.NewReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.RepSuccess, first.Rep)
+
+	// The peer connects to the address announced in the first reply
+	peer, err := net.Dial("tcp", first.Address())
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	second, err := socks5.NewReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.RepSuccess, second.Rep)
+	assert.Equal(t, peer.LocalAddr().String(), second.Address())
+
+	_, err = peer.Write([]byte("from peer"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, len("from peer"))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "from peer", string(buf))
+}
+
+func TestServer_Socks5BindNotSupported(t *testing.T) {
+	// The classic backend only supports CONNECT and UDP ASSOCIATE
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+	_, addr := startTestServer(t, newTestPool(backend))
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	socks5Handshake(t, conn, socks5.CmdBind, "127.0.0.1:21")
+
+	reply, err := socks5.NewReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.RepCommandNotSupported, reply.Rep)
+}
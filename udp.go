@@ -0,0 +1,246 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: udp.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:45:35
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 10:24:01
+ */
+
+package socks5lb
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/txthinking/socks5"
+)
+
+const (
+	// DefaultUDPIdleTimeout is the default time an association may stay without any datagram
+	DefaultUDPIdleTimeout = 60 * time.Second
+
+	// MaxUDPPacketSize is the largest payload of a UDP datagram over IPv4
+	MaxUDPPacketSize = 65507
+)
+
+type udpKey struct{}
+
+// WithUDP returns a context restricting the backends to the UDP capable ones
+func WithUDP(ctx context.Context) context.Context {
+	return context.WithValue(ctx, udpKey{}, true)
+}
+
+// UDPFrom reports whether the context asks for UDP capable backends
+func UDPFrom(ctx context.Context) bool {
+	udp, _ := ctx.Value(udpKey{}).(bool)
+	return udp
+}
+
+// udpAssociation relays datagrams between a client and the relay of a backend,
+// both sides use the same SOCKS5 UDP request header so packets are forwarded as is
+type udpAssociation struct {
+	clientIP   net.IP
+	clientAddr *net.UDPAddr
+	local      *net.UDPConn // datagrams from and to the client
+	remote     *net.UDPConn // datagrams from and to the backend relay
+	router     *Router      // drops datagrams to rejected targets
+
+	idle      time.Duration
+	idleTimer *time.Timer
+	lock      sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// close tears down the association, it is safe to call more than once
+func (a *udpAssociation) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		_ = a.local.Close()
+		_ = a.remote.Close()
+	})
+}
+
+// touch postpones the idle expiry of the association
+func (a *udpAssociation) touch() {
+	a.idleTimer.Reset(a.idle)
+}
+
+// client returns the UDP address of the client once the first datagram arrived
+func (a *udpAssociation) client() *net.UDPAddr {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.clientAddr
+}
+
+// fromClient forwards datagrams of the client to the backend relay
+func (a *udpAssociation) fromClient() {
+	defer a.close()
+
+	buf := make([]byte, MaxUDPPacketSize)
+	for {
+		n, addr, err := a.local.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		// Only accept datagrams from the host owning the control connection,
+		// and stick to the first port it sends from
+		a.lock.Lock()
+		if a.clientAddr == nil && addr.IP.Equal(a.clientIP) {
+			a.clientAddr = addr
+		}
+		accepted := a.clientAddr != nil && a.clientAddr.IP.Equal(addr.IP) && a.clientAddr.Port == addr.Port
+		a.lock.Unlock()
+
+		if !accepted {
+			log.Debugf("dropping UDP datagram from unassociated address %s", addr)
+			continue
+		}
+
+		datagram, err := socks5.NewDatagramFromBytes(buf[:n])
+		if err != nil {
+			log.Debugf("dropping malformed UDP datagram from %s: %v", addr, err)
+			continue
+		}
+
+		// Fragmentation is not supported, such datagrams must be dropped
+		if datagram.Frag != 0 {
+			log.Debugf("dropping fragmented UDP datagram from %s", addr)
+			continue
+		}
+
+		// The backend of the association is already chosen, only REJECT applies to each datagram
+		if target := datagram.Address(); a.router.Match(target).Outbound == OutboundReject {
+			log.Debugf("dropping UDP datagram from %s to rejected target %s", addr, target)
+			continue
+		}
+
+		a.touch()
+		if _, err := a.remote.Write(buf[:n]); err != nil {
+			log.Debugf("failed to forward UDP datagram to %s: %v", a.remote.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// fromRemote forwards datagrams of the backend relay back to the client
+func (a *udpAssociation) fromRemote() {
+	defer a.close()
+
+	buf := make([]byte, MaxUDPPacketSize)
+	for {
+		n, err := a.remote.Read(buf)
+		if err != nil {
+			return
+		}
+
+		clientAddr := a.client()
+		if clientAddr == nil {
+			continue
+		}
+
+		a.touch()
+		if _, err := a.local.WriteToUDP(buf[:n], clientAddr); err != nil {
+			log.Debugf("failed to forward UDP datagram to %s: %v", clientAddr, err)
+			return
+		}
+	}
+}
+
+// handleSocks5Associate serves the UDP ASSOCIATE command through a backend relay,
+// the association is released when the control connection or the backend goes away
+func (s *Server) handleSocks5Associate(ctx context.Context, socks5Conn net.Conn, _ *socks5.Request) {
+	var (
+		ctrl  net.Conn
+		relay *net.UDPAddr
+	)
+
+	backend, err := s.upstream(WithUDP(ctx), func(backend *Backend, timeout int) (err error) {
+		ctrl, relay, err = backend.Socks5Associate(timeout)
+		return
+	})
+	if err != nil {
+		log.Errorf("failed to open UDP association: %v", err)
+		_ = socks5Reply(socks5Conn, socks5ReplyCode(err), nil)
+		return
+	}
+	defer ctrl.Close()
+
+	remote, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		log.Errorf("failed to reach UDP relay %s of backend %s: %v", relay, backend.Addr, err)
+		_ = socks5Reply(socks5Conn, socks5.RepServerFailure, nil)
+		return
+	}
+
+	// Bind the local relay on the address the client connected to
+	localIP := socks5Conn.LocalAddr().(*net.TCPAddr).IP
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Errorf("failed to listen UDP relay on %s: %v", localIP, err)
+		_ = remote.Close()
+		_ = socks5Reply(socks5Conn, socks5.RepServerFailure, nil)
+		return
+	}
+
+	idle := time.Duration(s.Config.Sock5.UDPIdleTimeout) * time.Second
+	if idle == 0 {
+		idle = DefaultUDPIdleTimeout
+	}
+
+	association := &udpAssociation{
+		clientIP: socks5Conn.RemoteAddr().(*net.TCPAddr).IP,
+		local:    local,
+		remote:   remote,
+		router:   s.Router,
+		idle:     idle,
+		done:     make(chan struct{}),
+	}
+	association.idleTimer = time.AfterFunc(idle, association.close)
+	defer association.close()
+
+	// The timer fires on its own goroutine, it is stopped here rather than in close
+	// which it calls and which would read the field without synchronization
+	defer association.idleTimer.Stop()
+
+	if err := socks5Reply(socks5Conn, socks5.RepSuccess, local.LocalAddr()); err != nil {
+		log.Errorf("failed to reply to %s: %v", socks5Conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := socks5Conn.SetDeadline(time.Time{}); err != nil {
+		log.Warnf("failed to clear handshake deadline: %v", err)
+	}
+
+	log.Tracef("relaying UDP of %s via backend %s on %s", socks5Conn.RemoteAddr(), backend.Addr, local.LocalAddr())
+
+	backend.acquire()
+	defer backend.release()
+
+	go association.fromClient()
+	go association.fromRemote()
+
+	// The association terminates with either control connection
+	go func() {
+		_, _ = io.Copy(io.Discard, socks5Conn)
+		association.close()
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		association.close()
+	}()
+
+	<-association.done
+	log.Tracef("UDP association of %s is closed", socks5Conn.RemoteAddr())
+}
@@ -0,0 +1,97 @@
+/*!*
+ * Copyright (c) 2025 Hangzhou Guanwaii Technology Co., Ltd.
+ *
+ * This source code is licensed under the MIT License,
+ * which is located in the LICENSE file in the source tree's root directory.
+ *
+ * File: udp_test.go
+ * Author: mingcheng (mingcheng@apache.org)
+ * File Created: 2026-10-18 09:45:35
+ *
+ * Modified By: mingcheng (mingcheng@apache.org)
+ * Last Modified: 2026-10-18 09:45:35
+ */
+
+package socks5lb
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+// startUDPEchoServer starts a UDP server echoing every datagram back to the sender
+func startUDPEchoServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxUDPPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestServer_Socks5UDPAssociate(t *testing.T) {
+	echoAddr := startUDPEchoServer(t)
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	_, addr := startTestServer(t, newTestPool(backend))
+
+	client, err := socks5.NewClient(addr, "", "", 5, 5)
+	assert.NoError(t, err)
+
+	conn, err := client.Dial("udp", echoAddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	for _, message := range []string{"first datagram", "second datagram"} {
+		_, err = conn.Write([]byte(message))
+		assert.NoError(t, err)
+
+		buf := make([]byte, MaxUDPPacketSize)
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(buf[:n]))
+	}
+}
+
+func TestServer_Socks5UDPIdleExpiry(t *testing.T) {
+	backend := NewBackend(startSocks5Backend(t, "", ""), BackendCheckConfig{InitialAlive: true})
+
+	server, addr := startTestServer(t, newTestPool(backend))
+	server.Config.Sock5.UDPIdleTimeout = 1
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = socks5.NewNegotiationRequest([]byte{socks5.MethodNone}).WriteTo(conn)
+	assert.NoError(t, err)
+	_, err = socks5.NewNegotiationReplyFrom(conn)
+	assert.NoError(t, err)
+
+	_, err = socks5.NewRequest(socks5.CmdUDP, socks5.ATYPIPv4, []byte{0, 0, 0, 0}, []byte{0, 0}).WriteTo(conn)
+	assert.NoError(t, err)
+
+	reply, err := socks5.NewReplyFrom(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, socks5.RepSuccess, reply.Rep)
+
+	// Without any datagram the association expires and the control connection is closed
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "association should expire before the deadline")
+}